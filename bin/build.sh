@@ -6,5 +6,13 @@ go get github.com/gorilla/websocket
 go get github.com/sirupsen/logrus
 go get github.com/gorilla/mux
 go get github.com/spf13/viper
+go get github.com/spf13/pflag
+go get gopkg.in/yaml.v3
+go get golang.org/x/time/rate
+go get github.com/vmihailenco/msgpack/v5
+go get github.com/prometheus/client_golang/prometheus
+go get golang.org/x/crypto/bcrypt
 
-go build -ldflags "-linkmode external -extldflags -static" -o bin/server -i mafia-backend/src
+COMMIT=`git rev-parse --short HEAD 2>/dev/null || echo unknown`
+
+go build -ldflags "-linkmode external -extldflags -static -X main.Commit=$COMMIT" -o bin/server -i mafia-backend/src
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// accountSessionTTL is how long a login token stays valid.
+const accountSessionTTL = 30 * 24 * time.Hour
+
+var Accounts = NewAccountStore("")
+
+var ErrAccountExists = errors.New("username already registered")
+var ErrInvalidLogin = errors.New("invalid username or password")
+
+var accountNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,24}$`)
+
+// Account is a registered player, the username is reserved for it in every game.
+type Account struct {
+	Username     string      `json:"username"`
+	PasswordHash string      `json:"password_hash"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Stats        CareerStats `json:"stats"`
+	Ratings      Ratings     `json:"ratings"`
+}
+
+type accountSession struct {
+	account   *Account
+	expiresAt time.Time
+}
+
+// AccountStore keeps accounts in memory and rewrites path on every change when path is set.
+// Sessions are kept in memory only, players log in again after a restart.
+type AccountStore struct {
+	mutex    sync.Mutex
+	path     string
+	data     map[string]*Account
+	sessions map[string]*accountSession
+}
+
+type AccountRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type SessionView struct {
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+func NewAccountStore(path string) *AccountStore {
+	return &AccountStore{
+		path:     path,
+		data:     make(map[string]*Account, 0),
+		sessions: make(map[string]*accountSession, 0),
+	}
+}
+
+// LoadAccounts reads the accounts file, a missing file is an empty store.
+func LoadAccounts(path string) (*AccountStore, error) {
+	store := NewAccountStore(path)
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]*Account, 0)
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		return nil, err
+	}
+	for _, account := range accounts {
+		store.data[accountKey(account.Username)] = account
+	}
+
+	return store, nil
+}
+
+func accountKey(username string) string {
+	return strings.ToLower(username)
+}
+
+func ValidateAccount(username string, password string) error {
+	if !accountNameRe.MatchString(username) {
+		return errors.New("username must be 3 to 24 letters, digits, '_', '.' or '-'")
+	}
+
+	if len(password) < 8 || len(password) > 72 {
+		return errors.New("password must be 8 to 72 bytes")
+	}
+
+	return nil
+}
+
+func (s *AccountStore) Register(username string, password string) (*Account, error) {
+	if err := ValidateAccount(username, password); err != nil {
+		return nil, err
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.data[accountKey(username)]; ok {
+		return nil, ErrAccountExists
+	}
+
+	account := &Account{
+		Username:     username,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now(),
+	}
+	s.data[accountKey(username)] = account
+
+	if err := s.save(); err != nil {
+		delete(s.data, accountKey(username))
+		return nil, err
+	}
+
+	return account, nil
+}
+
+var dummyHash []byte
+var dummyHashOnce sync.Once
+
+// Login checks the password, unknown usernames take as long as wrong passwords.
+func (s *AccountStore) Login(username string, password string) (*Account, error) {
+	account := s.FindOne(username)
+
+	if account == nil {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return nil, ErrInvalidLogin
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return nil, ErrInvalidLogin
+	}
+
+	return account, nil
+}
+
+func (s *AccountStore) NewSession(account *Account) string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	token := hex.EncodeToString(b)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[token] = &accountSession{account: account, expiresAt: time.Now().Add(accountSessionTTL)}
+
+	return token
+}
+
+func (s *AccountStore) FindBySession(token string) *Account {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	session, ok := s.sessions[token]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(session.expiresAt) {
+		delete(s.sessions, token)
+		return nil
+	}
+
+	return session.account
+}
+
+func (s *AccountStore) RemoveSession(token string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, token)
+}
+
+func (s *AccountStore) FindOne(username string) *Account {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data[accountKey(username)]
+}
+
+// IsReserved reports whether username belongs to an account, names are compared case-insensitively.
+func (s *AccountStore) IsReserved(username string) bool {
+	return s.FindOne(username) != nil
+}
+
+// save rewrites the accounts file through a temporary file, so a crash never leaves it half written.
+func (s *AccountStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	accounts := make([]*Account, 0, len(s.data))
+	for _, account := range s.data {
+		accounts = append(accounts, account)
+	}
+
+	data, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
+
+func decodeAccountRequest(w http.ResponseWriter, r *http.Request) (AccountRequest, bool) {
+	request := AccountRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request")
+		return request, false
+	}
+
+	if !Logins.Allow(RemoteIP(r.RemoteAddr), Conf.Limits.LoginsPerMinute) {
+		writeError(w, http.StatusTooManyRequests, "too many attempts, try again later")
+		return request, false
+	}
+
+	return request, true
+}
+
+// apiRegister creates an account and logs it in.
+func apiRegister(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	account, err := Accounts.Register(request.Username, request.Password)
+	if err == ErrAccountExists {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if err != nil {
+		if ValidateAccount(request.Username, request.Password) != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		log.Errorf("Register account err: %v", err)
+		writeError(w, http.StatusInternalServerError, "can not save account")
+		return
+	}
+
+	log.WithField("account", account.Username).Info("Account registered")
+
+	writeJSON(w, http.StatusCreated, SessionView{Username: account.Username, Token: Accounts.NewSession(account)})
+}
+
+func apiLogin(w http.ResponseWriter, r *http.Request) {
+	request, ok := decodeAccountRequest(w, r)
+	if !ok {
+		return
+	}
+
+	account, err := Accounts.Login(request.Username, request.Password)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SessionView{Username: account.Username, Token: Accounts.NewSession(account)})
+}
+
+// apiLogout ends the session given by "Authorization: Bearer <token>".
+func apiLogout(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	Accounts.RemoveSession(token)
+	w.WriteHeader(http.StatusNoContent)
+}
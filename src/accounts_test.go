@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAccounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	store, _ := LoadAccounts(path)
+
+	if _, err := store.Register("Alice", "secret password"); err != nil {
+		t.Fatalf("Register err: %v", err)
+	}
+
+	if _, err := store.Register("alice", "other password"); err != ErrAccountExists {
+		t.Errorf("Usernames must be unique ignoring case, err: %v", err)
+	}
+
+	if _, err := store.Register("Bob", "short"); err == nil {
+		t.Errorf("Short password must be refused")
+	}
+
+	if _, err := store.Login("alice", "wrong password"); err != ErrInvalidLogin {
+		t.Errorf("Wrong password must be refused, err: %v", err)
+	}
+
+	loaded, err := LoadAccounts(path)
+	if err != nil {
+		t.Fatalf("Load accounts err: %v", err)
+	}
+
+	account, err := loaded.Login("ALICE", "secret password")
+	if err != nil || account.Username != "Alice" {
+		t.Fatalf("Account must be loaded from disk, err: %v", err)
+	}
+
+	if loaded.FindBySession(loaded.NewSession(account)) != account {
+		t.Errorf("Session must find the account")
+	}
+}
+
+func TestAccountPlayers(t *testing.T) {
+	accounts, logins, creations, limits := Accounts, Logins, GameCreations, Conf.Limits
+	defer func() { Accounts, Logins, GameCreations, Conf.Limits = accounts, logins, creations, limits }()
+	Accounts = NewAccountStore("")
+	Logins = NewWindowLimiter(time.Minute)
+	GameCreations = NewWindowLimiter(time.Minute)
+	Conf.Limits = DefaultLimitsConfig()
+
+	r := mux.NewRouter()
+	r.HandleFunc("/accounts", apiRegister)
+	r.HandleFunc("/accounts/login", apiLogin)
+
+	body, _ := json.Marshal(AccountRequest{Username: "Alice", Password: "secret password"})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/accounts", bytes.NewReader(body)))
+	session := SessionView{}
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &session) != nil || session.Token == "" {
+		t.Fatalf("Register must return a session, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/accounts", bytes.NewReader(body)))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Second register must conflict, got %d", w.Code)
+	}
+
+	wrong, _ := json.Marshal(AccountRequest{Username: "Alice", Password: "wrong password"})
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/accounts/login", bytes.NewReader(wrong)))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong password must be unauthorized, got %d", w.Code)
+	}
+
+	master := NewPlayer()
+	master.OnMessage(&Message{
+		Event:  EVENT_GAME,
+		Action: ACTION_CREATE,
+		Data:   map[string]interface{}{"username": "someone", "token": session.Token},
+	})
+	item, ok := master.send.Pop()
+	if !ok || item.Message.Action != ACTION_CREATE || item.Message.Status != STATUS_OK {
+		t.Fatalf("Logged in player must create a game, got %#v", item)
+	}
+	game := master.Game()
+	if game == nil {
+		t.Fatalf("Player has no game")
+	}
+	defer RemoveGame(game)
+	defer game.Stop()
+
+	if master.Name() != "Alice" || master.Account() == nil {
+		t.Errorf("Logged in player must play with the account name, got %s", master.Name())
+	}
+
+	for _, entry := range game.Journal.Entries() {
+		if data, ok := entry.Data.(map[string]interface{}); ok && data["token"] != nil {
+			t.Errorf("Token must not be journaled %#v", entry)
+		}
+	}
+
+	guest := NewPlayer()
+	guest.OnMessage(&Message{
+		Event:  EVENT_GAME,
+		Action: ACTION_JOIN,
+		Data:   map[string]interface{}{"username": "alice", "game": float64(game.Id)},
+	})
+	if !guest.ReceiveMessage(t, EVENT_GAME, ACTION_JOIN) || guest.Game() != nil {
+		t.Errorf("Guest must not join with a reserved name")
+	}
+
+	guest.OnMessage(&Message{
+		Event:  EVENT_GAME,
+		Action: ACTION_JOIN,
+		Data:   map[string]interface{}{"username": "guest", "game": float64(game.Id), "token": "invalid"},
+	})
+	if !guest.ReceiveMessage(t, EVENT_GAME, ACTION_JOIN) || guest.Game() != nil {
+		t.Errorf("Invalid token must be refused")
+	}
+}
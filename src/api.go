@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+type PlayerView struct {
+	Id       int    `json:"id"`
+	Username string `json:"username"`
+	Seat     int    `json:"seat"`
+	Avatar   string `json:"avatar"`
+	Color    string `json:"color"`
+	Status   string `json:"status"`
+	Master   bool   `json:"master"`
+	Out      bool   `json:"out"`
+}
+
+type GameView struct {
+	Id          int          `json:"id"`
+	Event       string       `json:"event"`
+	Iteration   int          `json:"iteration"`
+	IsOver      bool         `json:"is_over"`
+	Winner      int          `json:"winner,omitempty"`
+	Settings    GameSettings `json:"settings"`
+	PlayerCount int          `json:"player_count"`
+	Players     []PlayerView `json:"players"`
+}
+
+type ErrorView struct {
+	Error string `json:"error"`
+}
+
+// CreateGameRequest is the body of POST /games, seed replays a reported game and needs the admin token.
+type CreateGameRequest struct {
+	GameSettings
+	Seed *int64 `json:"seed"`
+}
+
+type ReplayView struct {
+	Game    int             `json:"game"`
+	Entries []*JournalEntry `json:"entries"`
+}
+
+func NewPlayerView(player *Player) PlayerView {
+	return PlayerView{
+		Id:       player.Id(),
+		Username: player.Name(),
+		Seat:     player.Seat(),
+		Avatar:   player.Avatar(),
+		Color:    player.Color(),
+		Status:   player.Status(),
+		Master:   player.Master(),
+		Out:      player.Out(),
+	}
+}
+
+// NewGameView is the public view of a game, roles and addresses are never exposed.
+func NewGameView(game *Game) GameView {
+	players := make([]PlayerView, 0)
+	for _, player := range game.Players.FindAllWithOut() {
+		players = append(players, NewPlayerView(player))
+	}
+
+	view := GameView{
+		Id:          game.Id,
+		Event:       game.Event.Name(),
+		Iteration:   game.Iteration,
+		IsOver:      game.isOver(),
+		Settings:    game.Settings,
+		PlayerCount: len(game.Players.FindAll()),
+		Players:     players,
+	}
+
+	if view.IsOver {
+		view.Winner = game.Winner
+	}
+
+	return view
+}
+
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Errorf("Write response error: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err string) {
+	writeJSON(w, status, ErrorView{Error: err})
+}
+
+// isAdmin checks the "Authorization: Bearer <token>" header against the admin token.
+func isAdmin(r *http.Request) bool {
+	if Conf.AdminToken == "" {
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(Conf.AdminToken)) == 1
+}
+
+func findGameByVars(w http.ResponseWriter, r *http.Request) *Game {
+	gameId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid game id")
+		return nil
+	}
+
+	game, ok := FindGame(gameId)
+	if !ok {
+		writeError(w, http.StatusNotFound, "game not found")
+		return nil
+	}
+
+	return game
+}
+
+func apiCreateGame(w http.ResponseWriter, r *http.Request) {
+	request := CreateGameRequest{GameSettings: DefaultGameSettings()}
+
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid settings")
+			return
+		}
+	}
+
+	if request.Seed != nil && !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin token required to set seed")
+		return
+	}
+
+	settings := request.GameSettings
+	err := settings.Validate()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if IsShuttingDown() {
+		writeError(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+
+	if !CanCreateGame() {
+		writeError(w, http.StatusServiceUnavailable, "too many games")
+		return
+	}
+
+	if !GameCreations.Allow(RemoteIP(r.RemoteAddr), Conf.Limits.GamesPerMinute) {
+		writeError(w, http.StatusTooManyRequests, "too many games created, try again later")
+		return
+	}
+
+	game := NewGame()
+	game.Settings = settings
+	if request.Seed != nil {
+		game.SetSeed(*request.Seed)
+	}
+	game.Run()
+	AddGame(game)
+	Lobby.Broadcast()
+
+	log.Infof("Game created over http id: %d", game.Id)
+
+	writeJSON(w, http.StatusCreated, NewGameView(game))
+}
+
+// apiListGames lists public games still waiting for players in the lobby.
+func apiListGames(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, FindLobbies())
+}
+
+func apiGetGame(w http.ResponseWriter, r *http.Request) {
+	game := findGameByVars(w, r)
+	if game == nil {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, NewGameView(game))
+}
+
+// apiReplayGame returns the journal of a game that is over, from memory or from journal_dir once the game is removed.
+func apiReplayGame(w http.ResponseWriter, r *http.Request) {
+	gameId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid game id")
+		return
+	}
+
+	if game, ok := FindGame(gameId); ok {
+		if game.FinishedAt.IsZero() && !game.isStopped() {
+			if game.Previous != nil {
+				writeJSON(w, http.StatusOK, ReplayView{Game: game.Id, Entries: game.Previous.Entries})
+				return
+			}
+
+			writeError(w, http.StatusConflict, "game is not over")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, ReplayView{Game: game.Id, Entries: game.Journal.Entries()})
+		return
+	}
+
+	entries, err := ReadJournal(gameId)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, "game not found")
+		return
+	}
+	if err != nil {
+		log.Errorf("Read journal id: %d, err: %v", gameId, err)
+		writeError(w, http.StatusInternalServerError, "can not read journal")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ReplayView{Game: gameId, Entries: entries})
+}
+
+// apiGameSummary returns the summary of a game that is over, a removed game is rebuilt from its journal.
+func apiGameSummary(w http.ResponseWriter, r *http.Request) {
+	gameId, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid game id")
+		return
+	}
+
+	game, ok := FindGame(gameId)
+	if !ok {
+		entries, err := ReadJournal(gameId)
+		if os.IsNotExist(err) {
+			writeError(w, http.StatusNotFound, "game not found")
+			return
+		}
+		if err == nil {
+			game, err = Rebuild(entries)
+		}
+		if err != nil {
+			log.Errorf("Rebuild game id: %d, err: %v", gameId, err)
+			writeError(w, http.StatusInternalServerError, "can not rebuild game")
+			return
+		}
+	}
+
+	if game.FinishedAt.IsZero() {
+		if game.Previous != nil {
+			writeJSON(w, http.StatusOK, game.Previous.Summary)
+			return
+		}
+
+		writeError(w, http.StatusConflict, "game is not over")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, NewGameSummary(game.Winner, game.Players, game.EventsHistory))
+}
+
+func apiDeleteGame(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin token required")
+		return
+	}
+
+	game := findGameByVars(w, r)
+	if game == nil {
+		return
+	}
+
+	game.Abort()
+	RemoveGame(game)
+
+	log.Infof("Game aborted over http id: %d", game.Id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGamesApi(t *testing.T) {
+	token := Conf.AdminToken
+	defer func() { Conf.AdminToken = token }()
+	Conf.AdminToken = "secret"
+
+	r := mux.NewRouter()
+	r.HandleFunc("/games", apiCreateGame).Methods("POST")
+	r.HandleFunc("/games", apiListGames).Methods("GET")
+	r.HandleFunc("/games/{id}", apiGetGame).Methods("GET")
+	r.HandleFunc("/games/{id}", apiDeleteGame).Methods("DELETE")
+
+	request := func(method string, url string, body string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("POST", "/games", `{"max_players": 5, "visibility": "public"}`, "")
+	view := GameView{}
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &view) != nil || view.Settings.MaxPlayers != 5 {
+		t.Fatalf("Wrong create response %d %s", w.Code, w.Body.String())
+	}
+	game, ok := FindGame(view.Id)
+	if !ok {
+		t.Fatalf("Created game must be registered")
+	}
+	defer RemoveGame(game)
+	defer game.Stop()
+
+	if w := request("POST", "/games", `{"visibility": "secret"}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid settings must be refused, got %d", w.Code)
+	}
+
+	if w := request("POST", "/games", `{"seed": 42}`, ""); w.Code != http.StatusForbidden {
+		t.Errorf("Seed without the admin token must be forbidden, got %d", w.Code)
+	}
+
+	w = request("POST", "/games", `{"seed": 42}`, "secret")
+	seeded := GameView{}
+	if w.Code != http.StatusCreated || json.Unmarshal(w.Body.Bytes(), &seeded) != nil {
+		t.Fatalf("Admin must create a seeded game, got %d %s", w.Code, w.Body.String())
+	}
+	if game, ok := FindGame(seeded.Id); !ok || game.Seed != 42 {
+		t.Errorf("Seed must be applied")
+	} else {
+		defer RemoveGame(game)
+		defer game.Stop()
+	}
+
+	lobbies := make([]LobbyView, 0)
+	w = request("GET", "/games", "", "")
+	json.Unmarshal(w.Body.Bytes(), &lobbies)
+	listed := map[int]bool{}
+	for _, lobby := range lobbies {
+		listed[lobby.Id] = true
+	}
+	if !listed[view.Id] || listed[seeded.Id] {
+		t.Errorf("Only public lobbies must be listed %v", listed)
+	}
+
+	if w := request("GET", "/games/"+strconv.Itoa(view.Id), "", ""); w.Code != http.StatusOK {
+		t.Errorf("Wrong get response %d", w.Code)
+	}
+	if w := request("GET", "/games/abc", "", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid id must be a bad request, got %d", w.Code)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if w := request("DELETE", "/games/"+strconv.Itoa(view.Id), "", token); w.Code != http.StatusForbidden {
+			t.Errorf("Delete without the admin token must be forbidden, got %d", w.Code)
+		}
+	}
+
+	if w := request("DELETE", "/games/"+strconv.Itoa(view.Id), "", "secret"); w.Code != http.StatusNoContent {
+		t.Errorf("Admin must delete the game, got %d", w.Code)
+	}
+	if w := request("GET", "/games/"+strconv.Itoa(view.Id), "", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Deleted game must be gone, got %d", w.Code)
+	}
+}
+
+func TestNewGameIdUnused(t *testing.T) {
+	games := make([]*Game, 0)
+	for i := 0; i < 200; i++ {
+		game := NewGame()
+		if _, ok := FindGame(game.Id); ok {
+			t.Fatalf("Id %d is already used", game.Id)
+		}
+		AddGame(game)
+		games = append(games, game)
+	}
+
+	for _, game := range games {
+		RemoveGame(game)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const AVATAR_MAX_SIZE = 64 * 1024
+const AVATAR_MAX_DIMENSION = 256
+const AVATAR_UPLOAD_PREFIX = "upload:"
+const PLAYER_STATUS_MAX_LENGTH = 64
+
+// AVATARS are the predefined avatars, clients ship the images.
+var AVATARS = []string{"bear", "cat", "dog", "fox", "owl", "panda", "rabbit", "wolf"}
+
+var Avatars = NewAvatarStore("")
+
+var avatarIdRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+var playerColorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+var avatarTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+// AvatarStore keeps uploaded avatars in dir, or in memory when dir is empty.
+// Avatars are named by the hash of the image, so the same image is stored once.
+type AvatarStore struct {
+	mutex sync.Mutex
+	dir   string
+	data  map[string][]byte
+}
+
+type AvatarView struct {
+	Avatar string `json:"avatar"`
+}
+
+func NewAvatarStore(dir string) *AvatarStore {
+	return &AvatarStore{
+		dir:  dir,
+		data: make(map[string][]byte, 0),
+	}
+}
+
+// ValidateAvatarImage accepts PNG, JPEG and GIF images up to AVATAR_MAX_SIZE bytes
+// and AVATAR_MAX_DIMENSION pixels on each side.
+func ValidateAvatarImage(data []byte) error {
+	if len(data) == 0 || len(data) > AVATAR_MAX_SIZE {
+		return errors.New("avatar must be 1 to 65536 bytes")
+	}
+
+	if !avatarTypes[http.DetectContentType(data)] {
+		return errors.New("avatar must be a png, jpeg or gif image")
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errors.New("avatar is not a valid image")
+	}
+
+	if config.Width > AVATAR_MAX_DIMENSION || config.Height > AVATAR_MAX_DIMENSION {
+		return errors.New("avatar must be at most 256x256 pixels")
+	}
+
+	return nil
+}
+
+// Save validates and stores an uploaded image and returns its id.
+func (s *AvatarStore) Save(data []byte) (string, error) {
+	if err := ValidateAvatarImage(data); err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+	id := hex.EncodeToString(hash[:16])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.dir == "" {
+		s.data[id] = data
+		return id, nil
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(s.dir, id)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", err
+	}
+
+	return id, os.Rename(tmp, path)
+}
+
+func (s *AvatarStore) Load(id string) ([]byte, bool) {
+	if !avatarIdRe.MatchString(id) {
+		return nil, false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.dir == "" {
+		data, ok := s.data[id]
+		return data, ok
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, id))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+func (s *AvatarStore) Exists(id string) bool {
+	if !avatarIdRe.MatchString(id) {
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.dir == "" {
+		_, ok := s.data[id]
+		return ok
+	}
+
+	_, err := os.Stat(filepath.Join(s.dir, id))
+	return err == nil
+}
+
+// ValidateAvatar accepts an empty avatar, a predefined one or "upload:<id>" of an uploaded image.
+func ValidateAvatar(avatar string) error {
+	if err := validateAvatarName(avatar); err != nil {
+		return err
+	}
+
+	if id := strings.TrimPrefix(avatar, AVATAR_UPLOAD_PREFIX); id != avatar && !Avatars.Exists(id) {
+		return errors.New("avatar is not uploaded")
+	}
+
+	return nil
+}
+
+// validateAvatarName checks the form of avatar only, not that the upload exists.
+func validateAvatarName(avatar string) error {
+	if avatar == "" {
+		return nil
+	}
+
+	for _, name := range AVATARS {
+		if avatar == name {
+			return nil
+		}
+	}
+
+	if id := strings.TrimPrefix(avatar, AVATAR_UPLOAD_PREFIX); id != avatar && avatarIdRe.MatchString(id) {
+		return nil
+	}
+
+	return errors.New("unknown avatar")
+}
+
+func ValidatePlayerStatus(status string) error {
+	if utf8.RuneCountInString(status) > PLAYER_STATUS_MAX_LENGTH {
+		return errors.New("status must be at most 64 characters")
+	}
+
+	for _, r := range status {
+		if unicode.IsControl(r) {
+			return errors.New("status can not contain control characters")
+		}
+	}
+
+	return nil
+}
+
+// applyAppearance sets the avatar, color and status sent with create, join or appearance.
+// Fields missing from data are kept, nothing is changed when a field is invalid.
+// A rebuild only checks the form of avatars, uploads accepted in the game may be gone since.
+func (p *Player) applyAppearance(data map[string]interface{}) error {
+	avatar, color, status := p.avatar, p.color, p.status
+
+	if value, ok := data["avatar"].(string); ok {
+		validate := ValidateAvatar
+		if p.discard {
+			validate = validateAvatarName
+		}
+		if err := validate(value); err != nil {
+			return err
+		}
+		avatar = value
+	}
+
+	if value, ok := data["color"].(string); ok {
+		if value != "" && !playerColorRe.MatchString(value) {
+			return errors.New("color must be #rrggbb")
+		}
+		color = strings.ToLower(value)
+	}
+
+	if value, ok := data["status"].(string); ok {
+		value = strings.TrimSpace(value)
+		if err := ValidatePlayerStatus(value); err != nil {
+			return err
+		}
+		status = value
+	}
+
+	p.avatar, p.color, p.status = avatar, color, status
+	return nil
+}
+
+// apiUploadAvatar stores the image sent as the body of POST /avatars and returns "upload:<id>".
+func apiUploadAvatar(w http.ResponseWriter, r *http.Request) {
+	if !Uploads.Allow(RemoteIP(r.RemoteAddr), Conf.Limits.UploadsPerMinute) {
+		writeError(w, http.StatusTooManyRequests, "too many uploads, try again later")
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, AVATAR_MAX_SIZE))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "avatar must be 1 to 65536 bytes")
+		return
+	}
+
+	if err := ValidateAvatarImage(data); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	id, err := Avatars.Save(data)
+	if err != nil {
+		log.Errorf("Save avatar err: %v", err)
+		writeError(w, http.StatusInternalServerError, "can not save avatar")
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, AvatarView{Avatar: AVATAR_UPLOAD_PREFIX + id})
+}
+
+// apiGetAvatar serves an uploaded image, images never change so they are cached for a year.
+func apiGetAvatar(w http.ResponseWriter, r *http.Request) {
+	data, ok := Avatars.Load(mux.Vars(r)["id"])
+	if !ok {
+		writeError(w, http.StatusNotFound, "avatar not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Write(data)
+}
+
+// apiListAvatars returns the predefined avatars.
+func apiListAvatars(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, AVATARS)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func encodePng(size int) []byte {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, size, size)))
+	return buf.Bytes()
+}
+
+func TestAvatars(t *testing.T) {
+	avatars := Avatars
+	defer func() { Avatars = avatars }()
+	Avatars = NewAvatarStore(t.TempDir())
+
+	r := mux.NewRouter()
+	r.HandleFunc("/avatars", apiUploadAvatar).Methods("POST")
+	r.HandleFunc("/avatars/{id}", apiGetAvatar).Methods("GET")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/avatars", bytes.NewReader(encodePng(64))))
+	view := AvatarView{}
+	if w.Code != 201 || json.Unmarshal(w.Body.Bytes(), &view) != nil || ValidateAvatar(view.Avatar) != nil {
+		t.Fatalf("Wrong upload response %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/avatars/"+view.Avatar[len(AVATAR_UPLOAD_PREFIX):], nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "image/png" || !bytes.Equal(w.Body.Bytes(), encodePng(64)) {
+		t.Errorf("Uploaded avatar must be served %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	for _, body := range [][]byte{encodePng(512), []byte("<svg></svg>"), make([]byte, AVATAR_MAX_SIZE+1)} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/avatars", bytes.NewReader(body)))
+		if w.Code != 400 && w.Code != 413 {
+			t.Errorf("Invalid avatar must be refused %d %s", w.Code, w.Body.String())
+		}
+	}
+
+	player := NewPlayer()
+	err := player.applyAppearance(map[string]interface{}{"avatar": "fox", "color": "#FF8800", "status": " ready "})
+	if err != nil || player.Avatar() != "fox" || player.Color() != "#ff8800" || player.Status() != "ready" {
+		t.Errorf("Wrong appearance %q %q %q, err: %v", player.Avatar(), player.Color(), player.Status(), err)
+	}
+
+	missing := AVATAR_UPLOAD_PREFIX + "0123456789abcdef0123456789abcdef"
+	for _, data := range []map[string]interface{}{{"avatar": "unicorn"}, {"avatar": missing}, {"color": "red"}, {"status": "a\nb"}} {
+		if player.applyAppearance(data) == nil || player.Avatar() != "fox" || player.Color() != "#ff8800" {
+			t.Errorf("Invalid appearance must be refused and keep the old one %v", data)
+		}
+	}
+
+	if err := player.applyAppearance(map[string]interface{}{"avatar": view.Avatar}); err != nil || player.Avatar() != view.Avatar {
+		t.Errorf("Uploaded avatar must be accepted, err: %v", err)
+	}
+
+	rebuilt := NewPlayer()
+	rebuilt.discard = true
+	if err := rebuilt.applyAppearance(map[string]interface{}{"avatar": missing}); err != nil {
+		t.Errorf("Rebuild must accept avatars that are not uploaded anymore, err: %v", err)
+	}
+
+	player.applyAppearance(map[string]interface{}{"avatar": "fox"})
+
+	game := NewGame()
+	player.SetName("anton")
+	player.SetGame(game)
+	game.Players.Add(player)
+
+	if info := NewPlayerInfo(player); info["avatar"] != "fox" || info["status"] != "ready" {
+		t.Errorf("Players list must have the appearance %v", info)
+	}
+
+	if lobby := NewLobbyView(game); len(lobby.Players) != 1 || lobby.Players[0].Color != "#ff8800" {
+		t.Errorf("Lobby view must have the players %#v", lobby.Players)
+	}
+}
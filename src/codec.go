@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+const CODEC_JSON = "json"
+const CODEC_MSGPACK = "msgpack"
+
+// Codec encodes and decodes messages on the wire.
+// The name of a codec is the websocket subprotocol a client asks for on upgrade.
+type Codec interface {
+	Name() string
+	MessageType() int
+	Marshal(message *Message) ([]byte, error)
+	Unmarshal(data []byte, message *Message) error
+}
+
+var Codecs = map[string]Codec{
+	CODEC_JSON:    &JSONCodec{},
+	CODEC_MSGPACK: &MsgpackCodec{},
+}
+
+// CodecNames returns the supported subprotocols, preferred first.
+func CodecNames() []string {
+	return []string{CODEC_MSGPACK, CODEC_JSON}
+}
+
+// FindCodec returns the codec for a negotiated subprotocol, JSON if none was negotiated.
+func FindCodec(name string) Codec {
+	if codec, ok := Codecs[name]; ok {
+		return codec
+	}
+
+	return Codecs[CODEC_JSON]
+}
+
+/*
+JSONCodec
+*/
+type JSONCodec struct{}
+
+func (c *JSONCodec) Name() string {
+	return CODEC_JSON
+}
+
+func (c *JSONCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+func (c *JSONCodec) Marshal(message *Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (c *JSONCodec) Unmarshal(data []byte, message *Message) error {
+	return json.Unmarshal(data, message)
+}
+
+/*
+MsgpackCodec
+*/
+type MsgpackCodec struct{}
+
+func (c *MsgpackCodec) Name() string {
+	return CODEC_MSGPACK
+}
+
+func (c *MsgpackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+// Marshal keys structs by their json tags, so msgpack clients get the same field names as JSON clients.
+func (c *MsgpackCodec) Marshal(message *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	if err := enc.Encode(message); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *MsgpackCodec) Unmarshal(data []byte, message *Message) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+	err := dec.Decode(message)
+	if err != nil {
+		return err
+	}
+
+	value, ok := normalizeMsgpackValue(message.Data)
+	if !ok {
+		return fmt.Errorf("unsupported data type %T", message.Data)
+	}
+	message.Data = value
+
+	return nil
+}
+
+// normalizeMsgpackValue converts decoded values to the types encoding/json produces,
+// so actions can read message data the same way whatever codec the client uses.
+func normalizeMsgpackValue(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case nil, bool, string, float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int8:
+		return float64(v), true
+	case int16:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case uint8:
+		return float64(v), true
+	case uint16:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case uint:
+		return float64(v), true
+	case []byte:
+		return string(v), true
+	case time.Time:
+		return v.Format(time.RFC3339Nano), true
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for index, item := range v {
+			normalized, ok := normalizeMsgpackValue(item)
+			if !ok {
+				return nil, false
+			}
+			list[index] = normalized
+		}
+		return list, true
+	case map[string]interface{}:
+		data := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized, ok := normalizeMsgpackValue(item)
+			if !ok {
+				return nil, false
+			}
+			data[key] = normalized
+		}
+		return data, true
+	case map[interface{}]interface{}:
+		data := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			normalized, ok := normalizeMsgpackValue(item)
+			if !ok {
+				return nil, false
+			}
+			data[fmt.Sprint(key)] = normalized
+		}
+		return data, true
+	}
+
+	return nil, false
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMsgpackCodec(t *testing.T) {
+	codec := FindCodec(CODEC_MSGPACK)
+
+	data, err := codec.Marshal(&Message{
+		Event:  EVENT_GAME,
+		Action: ACTION_JOIN,
+		Data:   map[string]interface{}{"username": "anton", "game": 12},
+	})
+	if err != nil {
+		t.Errorf("Marshal error: %v", err)
+		return
+	}
+
+	msg := &Message{}
+	err = codec.Unmarshal(data, msg)
+	if err != nil {
+		t.Errorf("Unmarshal error: %v", err)
+		return
+	}
+
+	if msg.Event != EVENT_GAME || msg.Action != ACTION_JOIN {
+		t.Errorf("Wrong message, {event: %s, action: %s}", msg.Event, msg.Action)
+		return
+	}
+
+	fields, ok := msg.Data.(map[string]interface{})
+	if !ok {
+		t.Errorf("Wrong data type %T", msg.Data)
+		return
+	}
+
+	if fields["game"] != float64(12) {
+		t.Errorf("Wrong game id %#v", fields["game"])
+	}
+
+	if fields["username"] != "anton" {
+		t.Errorf("Wrong username %#v", fields["username"])
+	}
+}
+
+func TestMsgpackCodecStructKeys(t *testing.T) {
+	codec := FindCodec(CODEC_MSGPACK)
+
+	data, err := codec.Marshal(&Message{
+		Event:  EVENT_GAME,
+		Action: ACTION_LOBBIES,
+		Data:   LobbyView{Id: 12, Host: "anton", PlayerCount: 3, Settings: GameSettings{Roles: RoleSetup{Doctor: true}}},
+	})
+	if err != nil {
+		t.Fatalf("Marshal error: %v", err)
+	}
+
+	msg := &Message{}
+	if err := codec.Unmarshal(data, msg); err != nil {
+		t.Fatalf("Unmarshal error: %v", err)
+	}
+
+	fields, ok := msg.Data.(map[string]interface{})
+	if !ok {
+		t.Fatalf("Wrong data type %T", msg.Data)
+	}
+
+	if fields["id"] != float64(12) || fields["host"] != "anton" || fields["player_count"] != float64(3) {
+		t.Errorf("Struct must be keyed by json tags %#v", fields)
+	}
+
+	settings, _ := fields["settings"].(map[string]interface{})
+	roles, _ := settings["roles"].(map[string]interface{})
+	if roles["doctor"] != true {
+		t.Errorf("Nested struct must be keyed by json tags %#v", settings)
+	}
+}
+
+func TestFindCodecDefault(t *testing.T) {
+	if FindCodec("").Name() != CODEC_JSON {
+		t.Errorf("Default codec must be json")
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+const LOG_FORMAT_LOGFMT = "logfmt"
+
+// Conf is the running configuration, tests and tools that never call LoadConfig get the defaults.
+var Conf = DefaultConfig()
+
+type Config struct {
+	Listen           string         `mapstructure:"listen" yaml:"listen"`
+	TLS              TLSConfig      `mapstructure:"tls" yaml:"tls"`
+	AllowedOrigins   []string       `mapstructure:"allowed_origins" yaml:"allowed_origins"`
+	Log              LogConfig      `mapstructure:"log" yaml:"log"`
+	Timeouts         TimeoutsConfig `mapstructure:"timeouts" yaml:"timeouts"`
+	Roles            RoleSetup      `mapstructure:"roles" yaml:"roles"`
+	Limits           LimitsConfig   `mapstructure:"limits" yaml:"limits"`
+	MaxGames         int            `mapstructure:"max_games" yaml:"max_games"`
+	MaxPlayers       int            `mapstructure:"max_players" yaml:"max_players"`
+	AdminToken       string         `mapstructure:"admin_token" yaml:"admin_token"`
+	LobbyTTL         time.Duration  `mapstructure:"lobby_ttl" yaml:"lobby_ttl"`
+	GameRetention    time.Duration  `mapstructure:"game_retention" yaml:"game_retention"`
+	ShutdownTimeout  time.Duration  `mapstructure:"shutdown_timeout" yaml:"shutdown_timeout"`
+	JournalDir       string         `mapstructure:"journal_dir" yaml:"journal_dir"`
+	JournalRetention time.Duration  `mapstructure:"journal_retention" yaml:"journal_retention"`
+	AccountsFile     string         `mapstructure:"accounts_file" yaml:"accounts_file"`
+	AvatarDir        string         `mapstructure:"avatar_dir" yaml:"avatar_dir"`
+}
+
+type TLSConfig struct {
+	Cert           string        `mapstructure:"cert" yaml:"cert"`
+	Key            string        `mapstructure:"key" yaml:"key"`
+	ReloadInterval time.Duration `mapstructure:"reload_interval" yaml:"reload_interval"`
+	RedirectListen string        `mapstructure:"redirect_listen" yaml:"redirect_listen"`
+}
+
+type LogConfig struct {
+	Level  string `mapstructure:"level" yaml:"level"`
+	Format string `mapstructure:"format" yaml:"format"`
+}
+
+// TimeoutsConfig limits how long a phase waits for players, zero waits forever.
+type TimeoutsConfig struct {
+	Accept time.Duration `mapstructure:"accept" yaml:"accept"`
+	Vote   time.Duration `mapstructure:"vote" yaml:"vote"`
+	Choice time.Duration `mapstructure:"choice" yaml:"choice"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Listen:         "0.0.0.0:4000",
+		AllowedOrigins: []string{},
+		TLS: TLSConfig{
+			ReloadInterval: time.Minute,
+		},
+		Log: LogConfig{
+			Level:  "debug",
+			Format: LOG_FORMAT_TEXT,
+		},
+		Roles:            DefaultRoleSetup(),
+		Limits:           DefaultLimitsConfig(),
+		LobbyTTL:         30 * time.Minute,
+		GameRetention:    10 * time.Minute,
+		ShutdownTimeout:  5 * time.Minute,
+		JournalDir:       "journal",
+		JournalRetention: 7 * 24 * time.Hour,
+		AccountsFile:     "accounts.json",
+		AvatarDir:        "avatars",
+	}
+}
+
+func (c *Config) Validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen: %v", err)
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return fmt.Errorf("tls: cert and key must be set together")
+	}
+
+	if c.TLS.ReloadInterval <= 0 {
+		return fmt.Errorf("tls.reload_interval must be positive")
+	}
+
+	if c.TLS.RedirectListen != "" {
+		if c.TLS.Cert == "" {
+			return fmt.Errorf("tls.redirect_listen needs tls.cert and tls.key")
+		}
+
+		if _, _, err := net.SplitHostPort(c.TLS.RedirectListen); err != nil {
+			return fmt.Errorf("tls.redirect_listen: %v", err)
+		}
+	}
+
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		return fmt.Errorf("log.level: %v", err)
+	}
+
+	if c.Log.Format != LOG_FORMAT_TEXT && c.Log.Format != LOG_FORMAT_JSON && c.Log.Format != LOG_FORMAT_LOGFMT {
+		return fmt.Errorf("log.format must be %s, %s or %s", LOG_FORMAT_TEXT, LOG_FORMAT_JSON, LOG_FORMAT_LOGFMT)
+	}
+
+	if c.Timeouts.Accept < 0 || c.Timeouts.Vote < 0 || c.Timeouts.Choice < 0 {
+		return fmt.Errorf("timeouts can not be negative")
+	}
+
+	if err := c.Roles.Validate(); err != nil {
+		return fmt.Errorf("roles: %v", err)
+	}
+
+	if c.Limits.ConnectionsPerIP < 0 || c.Limits.MessagesPerSecond < 0 || c.Limits.MessageBurst < 0 ||
+		c.Limits.MaxViolations < 0 || c.Limits.GamesPerMinute < 0 || c.Limits.LoginsPerMinute < 0 ||
+		c.Limits.UploadsPerMinute < 0 {
+		return fmt.Errorf("limits can not be negative")
+	}
+
+	if c.Limits.MessagesPerSecond != 0 && c.Limits.MessageBurst == 0 {
+		return fmt.Errorf("limits.message_burst must be positive when limits.messages_per_second is set")
+	}
+
+	if c.Limits.OutboundQueue < 1 {
+		return fmt.Errorf("limits.outbound_queue must be positive")
+	}
+
+	if c.MaxGames < 0 {
+		return fmt.Errorf("max_games can not be negative")
+	}
+
+	if c.MaxPlayers != 0 && c.MaxPlayers < 3 {
+		return fmt.Errorf("max_players must be 0 or at least 3")
+	}
+
+	if c.LobbyTTL <= 0 || c.GameRetention <= 0 {
+		return fmt.Errorf("lobby_ttl and game_retention must be positive")
+	}
+
+	if c.JournalRetention != 0 && c.JournalRetention < c.GameRetention {
+		return fmt.Errorf("journal_retention must be 0 or at least game_retention")
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return fmt.Errorf("shutdown_timeout can not be negative")
+	}
+
+	return nil
+}
+
+// Print writes the configuration as YAML, the admin token is hidden.
+func (c *Config) Print(w io.Writer) error {
+	printable := *c
+	if printable.AdminToken != "" {
+		printable.AdminToken = "<hidden>"
+	}
+
+	encoder := yaml.NewEncoder(w)
+	defer encoder.Close()
+	return encoder.Encode(printable)
+}
+
+// LoadConfig reads the configuration from defaults, the YAML file given by --config,
+// MAFIA_* environment variables and flags, in increasing order of priority.
+// printConfig is true when the configuration should be printed instead of serving.
+func LoadConfig(args []string) (config *Config, printConfig bool, err error) {
+	defaults := DefaultConfig()
+
+	flags := pflag.NewFlagSet("server", pflag.ContinueOnError)
+	configFile := flags.String("config", "", "path to a YAML config file")
+	printFlag := flags.Bool("print-config", false, "print the configuration and exit")
+	port := flags.Int("port", 0, "port to listen on all interfaces, overrides listen")
+	flags.String("listen", defaults.Listen, "address to listen on")
+	flags.String("tls-cert", "", "TLS certificate file")
+	flags.String("tls-key", "", "TLS key file")
+	flags.String("tls-redirect-listen", "", "address of a plain HTTP listener redirecting to https")
+	flags.StringSlice("allowed-origins", defaults.AllowedOrigins, "allowed websocket origins, any origin if empty")
+	flags.String("log-level", defaults.Log.Level, "log level")
+	flags.String("log-format", defaults.Log.Format, "log format: text, json or logfmt")
+	flags.Int("max-games", defaults.MaxGames, "maximum number of games, unlimited if 0")
+	flags.Int("max-players", defaults.MaxPlayers, "maximum number of players in a game, unlimited if 0")
+	flags.String("admin-token", "", "token for admin endpoints, admin endpoints are disabled if empty")
+	flags.Duration("lobby-ttl", defaults.LobbyTTL, "remove lobbies and abandoned games without activity for this long")
+	flags.Duration("game-retention", defaults.GameRetention, "remove finished games after this long")
+	flags.String("journal-dir", defaults.JournalDir, "directory for game journals, journals are kept in memory only if empty")
+	flags.Duration("journal-retention", defaults.JournalRetention, "remove journal files not written for this long, kept forever if 0")
+	flags.String("accounts-file", defaults.AccountsFile, "file for player accounts, accounts are kept in memory only if empty")
+	flags.String("avatar-dir", defaults.AvatarDir, "directory for uploaded avatars, avatars are kept in memory only if empty")
+	flags.Duration("shutdown-timeout", defaults.ShutdownTimeout, "wait this long for running games on SIGTERM")
+
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	v := viper.New()
+	v.SetConfigType("yaml")
+	v.SetEnvPrefix("mafia")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	v.SetDefault("listen", defaults.Listen)
+	v.SetDefault("tls.cert", defaults.TLS.Cert)
+	v.SetDefault("tls.key", defaults.TLS.Key)
+	v.SetDefault("tls.reload_interval", defaults.TLS.ReloadInterval)
+	v.SetDefault("tls.redirect_listen", defaults.TLS.RedirectListen)
+	v.SetDefault("allowed_origins", defaults.AllowedOrigins)
+	v.SetDefault("log.level", defaults.Log.Level)
+	v.SetDefault("log.format", defaults.Log.Format)
+	v.SetDefault("timeouts.accept", defaults.Timeouts.Accept)
+	v.SetDefault("timeouts.vote", defaults.Timeouts.Vote)
+	v.SetDefault("timeouts.choice", defaults.Timeouts.Choice)
+	v.SetDefault("roles.mafia_divisor", defaults.Roles.MafiaDivisor)
+	v.SetDefault("roles.doctor", defaults.Roles.Doctor)
+	v.SetDefault("roles.girl", defaults.Roles.Girl)
+	v.SetDefault("roles.sheriff", defaults.Roles.Sheriff)
+	v.SetDefault("limits.connections_per_ip", defaults.Limits.ConnectionsPerIP)
+	v.SetDefault("limits.messages_per_second", defaults.Limits.MessagesPerSecond)
+	v.SetDefault("limits.message_burst", defaults.Limits.MessageBurst)
+	v.SetDefault("limits.max_violations", defaults.Limits.MaxViolations)
+	v.SetDefault("limits.games_per_minute", defaults.Limits.GamesPerMinute)
+	v.SetDefault("limits.outbound_queue", defaults.Limits.OutboundQueue)
+	v.SetDefault("limits.logins_per_minute", defaults.Limits.LoginsPerMinute)
+	v.SetDefault("limits.uploads_per_minute", defaults.Limits.UploadsPerMinute)
+	v.SetDefault("max_games", defaults.MaxGames)
+	v.SetDefault("max_players", defaults.MaxPlayers)
+	v.SetDefault("admin_token", defaults.AdminToken)
+	v.SetDefault("lobby_ttl", defaults.LobbyTTL)
+	v.SetDefault("game_retention", defaults.GameRetention)
+	v.SetDefault("shutdown_timeout", defaults.ShutdownTimeout)
+	v.SetDefault("journal_dir", defaults.JournalDir)
+	v.SetDefault("journal_retention", defaults.JournalRetention)
+	v.SetDefault("accounts_file", defaults.AccountsFile)
+	v.SetDefault("avatar_dir", defaults.AvatarDir)
+
+	bindings := map[string]string{
+		"listen":              "listen",
+		"tls.cert":            "tls-cert",
+		"tls.key":             "tls-key",
+		"tls.redirect_listen": "tls-redirect-listen",
+		"allowed_origins":     "allowed-origins",
+		"log.level":           "log-level",
+		"log.format":          "log-format",
+		"max_games":           "max-games",
+		"max_players":         "max-players",
+		"admin_token":         "admin-token",
+		"lobby_ttl":           "lobby-ttl",
+		"game_retention":      "game-retention",
+		"shutdown_timeout":    "shutdown-timeout",
+		"journal_dir":         "journal-dir",
+		"journal_retention":   "journal-retention",
+		"accounts_file":       "accounts-file",
+		"avatar_dir":          "avatar-dir",
+	}
+	for key, name := range bindings {
+		if err := v.BindPFlag(key, flags.Lookup(name)); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if *configFile != "" {
+		v.SetConfigFile(*configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, false, fmt.Errorf("read config %s: %v", *configFile, err)
+		}
+	}
+
+	config = &Config{}
+	if err := v.Unmarshal(config); err != nil {
+		return nil, false, fmt.Errorf("decode config: %v", err)
+	}
+
+	if *port != 0 {
+		config.Listen = fmt.Sprintf("0.0.0.0:%d", *port)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	return config, *printFlag, nil
+}
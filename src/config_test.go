@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	os.Setenv("MAFIA_MAX_GAMES", "10")
+	os.Setenv("MAFIA_LOG_LEVEL", "info")
+	defer os.Unsetenv("MAFIA_MAX_GAMES")
+	defer os.Unsetenv("MAFIA_LOG_LEVEL")
+
+	config, printConfig, err := LoadConfig([]string{"--port=8000", "--log-level=warning", "--lobby-ttl=1m"})
+	if err != nil {
+		t.Errorf("Load config error: %v", err)
+		return
+	}
+
+	if printConfig {
+		t.Errorf("Config must not be printed")
+	}
+
+	if config.Listen != "0.0.0.0:8000" {
+		t.Errorf("Wrong listen %s", config.Listen)
+	}
+
+	if config.MaxGames != 10 {
+		t.Errorf("Env was not applied, max_games: %d", config.MaxGames)
+	}
+
+	if config.Log.Level != "warning" {
+		t.Errorf("Flag must override env, log.level: %s", config.Log.Level)
+	}
+
+	if config.LobbyTTL != time.Minute {
+		t.Errorf("Wrong lobby_ttl %v", config.LobbyTTL)
+	}
+
+	if config.Roles != DefaultRoleSetup() {
+		t.Errorf("Wrong default roles %#v", config.Roles)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	_, _, err := LoadConfig([]string{"--log-format=xml"})
+	if err == nil {
+		t.Errorf("Invalid log format was accepted")
+	}
+}
@@ -4,9 +4,6 @@ import (
 	"fmt"
 	"math"
 	"math/rand"
-	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 const NOT_IN_PROCESS = 1
@@ -41,6 +38,20 @@ const ACTION_ACCEPT = "accept"
 const ACTION_VOTE = "vote"
 const ACTION_CHOICE = "choice"
 const ACTION_OUT = "out"
+const ACTION_ABORT = "abort"
+const ACTION_LOBBIES = "lobbies"
+const ACTION_LEAVE = "leave"
+const ACTION_MASTER = "master"
+const ACTION_SERVER_SHUTDOWN = "server_shutdown"
+const ACTION_SUMMARY = "summary"
+const ACTION_PROFILE = "profile"
+const ACTION_REMATCH = "rematch"
+const ACTION_APPEARANCE = "appearance"
+
+// ITimeoutEvent is implemented by events that have to finish their work when players do not answer in time.
+type ITimeoutEvent interface {
+	Timeout(players *Players, history *EventHistory) error
+}
 
 type IEvent interface {
 	AddAction(name string, f func(players *Players, history *EventHistory, player *Player, msg *Message) error)
@@ -234,6 +245,11 @@ func (e *EventHistory) Push(event IEvent) {
 	e.data = append(e.data, event)
 }
 
+// FindAll returns the finished events in the order they were played.
+func (e *EventHistory) FindAll() []IEvent {
+	return e.data
+}
+
 func (e *EventHistory) FindEventChoice(eventName string, iteration int) IEventChoice {
 	for _, event := range e.data {
 		if event.Name() == eventName && event.Iteration() == iteration {
@@ -354,11 +370,7 @@ func (event *CourtEvent) Process(players *Players, history *EventHistory) error
 
 	playersInfo := make([]interface{}, 0)
 	for _, player := range players.FindAll() {
-		playerInfo := map[string]interface{}{
-			"username": player.Name(),
-			"id":       player.Id(),
-		}
-		playersInfo = append(playersInfo, playerInfo)
+		playersInfo = append(playersInfo, NewPlayerInfo(player))
 	}
 
 	response := NewEventMessage(event, ACTION_PLAYERS)
@@ -373,8 +385,7 @@ func (event *CourtEvent) Process(players *Players, history *EventHistory) error
 
 func (event *CourtEvent) VoteAction(players *Players, history *EventHistory, player *Player, msg *Message) error {
 
-	voteId := int(msg.Data.(float64))
-	vote := players.FindOneById(voteId)
+	vote := players.FindTarget(msg.Data)
 
 	if vote == nil {
 		rmsg := NewEventMessage(event, ACTION_PLAYERS)
@@ -407,6 +418,7 @@ CourtResult
 type CourtResultEvent struct {
 	Event
 	AcceptEvent
+	convicted *Player
 }
 
 func NewCourtResultEvent(iter int) *CourtResultEvent {
@@ -473,7 +485,9 @@ func (event *CourtResultEvent) Process(players *Players, history *EventHistory)
 	rmsg.Data = map[string]interface{}{"id": courtCandidate.Id(), "username": courtCandidate.Name()}
 
 	playersFor := players.FindAll()
+	event.convicted = courtCandidate
 	courtCandidate.SetOut(true)
+	courtCandidate.Log().Info("Player is out by court")
 	for _, player := range playersFor {
 		player.SendMessage(rmsg)
 	}
@@ -481,6 +495,11 @@ func (event *CourtResultEvent) Process(players *Players, history *EventHistory)
 	return nil
 }
 
+// Convicted is the player sent out by the court, nil when the court sent nobody out.
+func (event *CourtResultEvent) Convicted() *Player {
+	return event.convicted
+}
+
 func (event *CourtResultEvent) AcceptAction(players *Players, history *EventHistory, player *Player, msg *Message) error {
 	event.AddAccepted(player)
 
@@ -521,11 +540,7 @@ func (event *DoctorEvent) Process(players *Players, history *EventHistory) error
 
 	playersInfo := make([]interface{}, 0)
 	for _, player := range players.FindAll() {
-		playerInfo := map[string]interface{}{
-			"username": player.Name(),
-			"id":       player.Id(),
-		}
-		playersInfo = append(playersInfo, playerInfo)
+		playersInfo = append(playersInfo, NewPlayerInfo(player))
 	}
 
 	response := NewEventMessage(event, ACTION_PLAYERS)
@@ -547,8 +562,7 @@ func (event *DoctorEvent) ChoiceAction(players *Players, history *EventHistory,
 		return fmt.Errorf(err)
 	}
 
-	choiceId := int(msg.Data.(float64))
-	choice := players.FindOneById(choiceId)
+	choice := players.FindTarget(msg.Data)
 
 	if choice == nil {
 		rmsg := NewEventMessage(event, ACTION_CHOICE)
@@ -593,6 +607,8 @@ func NewGameEvent() *GameEvent {
 	e.AddAction(ACTION_CREATE, e.CreateAction)
 	e.AddAction(ACTION_JOIN, e.JoinAction)
 	e.AddAction(ACTION_START, e.StartAction)
+	e.AddAction(ACTION_LEAVE, e.LeaveAction)
+	e.AddAction(ACTION_APPEARANCE, e.AppearanceAction)
 	return e
 }
 
@@ -602,15 +618,20 @@ func (event *GameEvent) CreateAction(players *Players, history *EventHistory, pl
 
 	username := data["username"].(string)
 
+	settings := player.Game().Settings
+	if err := settings.Apply(data); err != nil {
+		return event.rejectCreate(players, player, err)
+	}
+
 	if players.FindOneByUsername(username) != nil {
-		rmsg := NewEventMessage(event, ACTION_CREATE)
-		rmsg.Status = STATUS_ERR
-		err := "username already exists"
-		rmsg.Data = err
-		player.SendMessage(rmsg)
-		return fmt.Errorf(err)
+		return event.rejectCreate(players, player, fmt.Errorf("username already exists"))
 	}
 
+	if err := player.applyAppearance(data); err != nil {
+		return event.rejectCreate(players, player, err)
+	}
+	player.Game().Settings = settings
+
 	player.SetName(username)
 	players.Add(player)
 
@@ -621,9 +642,42 @@ func (event *GameEvent) CreateAction(players *Players, history *EventHistory, pl
 
 	event.sendPlayersInfo(players)
 
+	Lobby.Broadcast()
+
 	return nil
 }
 
+// rejectCreate answers a refused create. The game created for it is removed while nobody sits at it,
+// so a refused create never leaves an empty lobby behind.
+func (event *GameEvent) rejectCreate(players *Players, player *Player, err error) error {
+	rmsg := NewEventMessage(event, ACTION_CREATE)
+	rmsg.Status = STATUS_ERR
+	rmsg.Data = err.Error()
+	player.SendMessage(rmsg)
+
+	if game := player.Game(); len(players.FindAllWithOut()) == 0 {
+		player.SetGame(nil)
+		player.SetMaster(false)
+		game.Stop()
+		RemoveGame(game)
+		Lobby.Broadcast()
+	}
+
+	return err
+}
+
+// rejectJoin answers a refused join, the player is not in the game and can create or join another one.
+func (event *GameEvent) rejectJoin(player *Player, err error) error {
+	rmsg := NewEventMessage(event, ACTION_JOIN)
+	rmsg.Status = STATUS_ERR
+	rmsg.Data = err.Error()
+	player.SendMessage(rmsg)
+
+	player.SetGame(nil)
+
+	return err
+}
+
 func (event *GameEvent) JoinAction(players *Players, history *EventHistory, player *Player, msg *Message) error {
 
 	data := msg.Data.(map[string]interface{})
@@ -631,12 +685,19 @@ func (event *GameEvent) JoinAction(players *Players, history *EventHistory, play
 	username := data["username"].(string)
 
 	if players.FindOneByUsername(username) != nil {
-		rmsg := NewEventMessage(event, ACTION_JOIN)
-		rmsg.Status = STATUS_ERR
-		err := "username already exists"
-		rmsg.Data = err
-		player.SendMessage(rmsg)
-		return fmt.Errorf(err)
+		return event.rejectJoin(player, fmt.Errorf("username already exists"))
+	}
+
+	if player.Game().isFull() {
+		return event.rejectJoin(player, fmt.Errorf("game is full"))
+	}
+
+	if err := player.applyAppearance(data); err != nil {
+		return event.rejectJoin(player, err)
+	}
+
+	if len(players.FindAll()) == 0 {
+		player.SetMaster(true)
 	}
 
 	player.SetName(username)
@@ -649,15 +710,71 @@ func (event *GameEvent) JoinAction(players *Players, history *EventHistory, play
 
 	event.sendPlayersInfo(players)
 
+	Lobby.Broadcast()
+
+	return nil
+}
+
+// LeaveAction removes the player from the lobby, the master role goes to the player who joined next.
+// The game is removed when the last player leaves.
+func (event *GameEvent) LeaveAction(players *Players, history *EventHistory, player *Player, msg *Message) error {
+	game := player.Game()
+
+	players.Remove(player)
+	player.SetGame(nil)
+
+	response := NewEventMessage(event, ACTION_LEAVE)
+	player.SendMessage(response)
+
+	if len(players.FindAll()) == 0 {
+		game.Stop()
+		RemoveGame(game)
+		Lobby.Broadcast()
+		return nil
+	}
+
+	if player.Master() {
+		player.SetMaster(false)
+		master := players.FindAll()[0]
+		master.SetMaster(true)
+		master.SendMessage(NewEventMessage(event, ACTION_MASTER))
+	}
+
+	event.sendPlayersInfo(players)
+
+	Lobby.Broadcast()
+
+	return nil
+}
+
+// AppearanceAction changes the avatar, color or status of the player in the lobby.
+func (event *GameEvent) AppearanceAction(players *Players, history *EventHistory, player *Player, msg *Message) error {
+	data, ok := msg.Data.(map[string]interface{})
+	if !ok {
+		data = make(map[string]interface{}, 0)
+	}
+
+	if err := player.applyAppearance(data); err != nil {
+		rmsg := NewEventMessage(event, ACTION_APPEARANCE)
+		rmsg.Status = STATUS_ERR
+		rmsg.Data = err.Error()
+		player.SendMessage(rmsg)
+		return err
+	}
+
+	event.sendPlayersInfo(players)
+
+	Lobby.Broadcast()
+
 	return nil
 }
 
 func (event *GameEvent) sendPlayersInfo(players *Players) {
 	playersInfo := make([]interface{}, 0)
 	for _, player := range players.FindAll() {
-		playerInfo := map[string]interface{}{
-			"username": player.Name(),
-			"id":       player.Id(),
+		playerInfo := NewPlayerInfo(player)
+		if player.Account() != nil {
+			playerInfo["rating"] = Accounts.Ratings(player.Account())
 		}
 		playersInfo = append(playersInfo, playerInfo)
 	}
@@ -689,8 +806,15 @@ func (event *GameEvent) StartAction(players *Players, history *EventHistory, pla
 		return fmt.Errorf(err)
 	}
 
+	if player.Game().Settings.ShuffleSeats {
+		players.ShuffleSeats(player.Game().Rand())
+		event.sendPlayersInfo(players)
+	}
+
 	event.SetStatus(PROCESSED)
 
+	Lobby.Broadcast()
+
 	return nil
 }
 
@@ -724,11 +848,7 @@ func (event *GirlEvent) Process(players *Players, history *EventHistory) error {
 
 	playersInfo := make([]interface{}, 0)
 	for _, player := range players.FindAll() {
-		playerInfo := map[string]interface{}{
-			"username": player.Name(),
-			"id":       player.Id(),
-		}
-		playersInfo = append(playersInfo, playerInfo)
+		playersInfo = append(playersInfo, NewPlayerInfo(player))
 	}
 
 	response := NewEventMessage(event, ACTION_PLAYERS)
@@ -750,8 +870,7 @@ func (event *GirlEvent) ChoiceAction(players *Players, history *EventHistory, pl
 		return fmt.Errorf(err)
 	}
 
-	choiceId := int(msg.Data.(float64))
-	choice := players.FindOneById(choiceId)
+	choice := players.FindTarget(msg.Data)
 
 	if choice == nil {
 		rmsg := NewEventMessage(event, ACTION_CHOICE)
@@ -787,9 +906,11 @@ GreetCitizensEvent
 type GreetCitizensEvent struct {
 	Event
 	AcceptEvent
+	roles RoleSetup
+	rng   *rand.Rand
 }
 
-func NewGreetCitizensEvent(iter int) *GreetCitizensEvent {
+func NewGreetCitizensEvent(iter int, roles RoleSetup, rng *rand.Rand) *GreetCitizensEvent {
 	e := &GreetCitizensEvent{}
 	e.Event = NewEvent()
 	e.status = NOT_IN_PROCESS
@@ -797,11 +918,13 @@ func NewGreetCitizensEvent(iter int) *GreetCitizensEvent {
 	e.iteration = iter
 	e.AddAction(ACTION_ACCEPT, e.AcceptAction)
 	e.accepted = make([]*Player, 0)
+	e.roles = roles
+	e.rng = rng
 	return e
 }
 
-func Shuffle(vals []int) []int {
-	r := rand.New(rand.NewSource(time.Now().Unix()))
+// Shuffle returns vals in random order drawn from r, vals is consumed.
+func Shuffle(r *rand.Rand, vals []int) []int {
 	ret := make([]int, len(vals))
 	n := len(vals)
 	for i := 0; i < n; i++ {
@@ -816,9 +939,10 @@ func (event *GreetCitizensEvent) Process(players *Players, history *EventHistory
 	event.status = IN_PROCESS
 
 	playersCount := len(players.FindAll())
-	roles := Shuffle(event.getRoles(playersCount))
+	roles := Shuffle(event.rng, event.getRoles(playersCount))
 	for index, player := range players.FindAll() {
 		player.SetRole(roles[index])
+		player.Log().Info("Role dealt")
 
 		rmsg := NewEventMessage(event, ACTION_ROLE)
 		rmsg.Data = player.Role()
@@ -839,6 +963,12 @@ func (event *GreetCitizensEvent) AcceptAction(players *Players, history *EventHi
 }
 
 func (event *GreetCitizensEvent) getRoles(playersCount int) []int {
+	return event.roles.Deal(playersCount)
+}
+
+// Deal returns the roles dealt to a table of playersCount players.
+// Tables of 3 and 4 players get one mafia and a reduced set of active roles.
+func (setup RoleSetup) Deal(playersCount int) []int {
 	roles := make([]int, 0)
 
 	mafia := 0
@@ -849,25 +979,38 @@ func (event *GreetCitizensEvent) getRoles(playersCount int) []int {
 
 	switch true {
 	case playersCount >= 5:
-		mafia = int(math.Floor(float64(playersCount / 3)))
-		girl = 1
-		sheriff = 1
-		doctor = 1
-		citizens = playersCount - (girl + sheriff + doctor + mafia)
+		mafia = int(math.Max(1, math.Floor(float64(playersCount/setup.MafiaDivisor))))
+		if setup.Girl {
+			girl = 1
+		}
+		if setup.Sheriff {
+			sheriff = 1
+		}
+		if setup.Doctor {
+			doctor = 1
+		}
 		break
 	case playersCount == 3:
 		mafia = 1
-		doctor = 1
-		citizens = 1
+		if setup.Doctor {
+			doctor = 1
+		}
 		break
 	case playersCount == 4:
 		mafia = 1
-		girl = 1
-		doctor = 1
-		citizens = 1
+		if setup.Girl {
+			girl = 1
+		}
+		if setup.Doctor {
+			doctor = 1
+		}
 		break
 	}
 
+	if mafia != 0 {
+		citizens = playersCount - (girl + sheriff + doctor + mafia)
+	}
+
 	for i := 1; i <= mafia; i++ {
 		roles = append(roles, ROLE_MAFIA)
 	}
@@ -919,11 +1062,7 @@ func (event *GreetMafiaEvent) Process(players *Players, history *EventHistory) e
 		if player.Role() != ROLE_MAFIA {
 			continue
 		}
-		playerInfo := map[string]interface{}{
-			"username": player.Name(),
-			"id":       player.Id(),
-		}
-		playersInfo = append(playersInfo, playerInfo)
+		playersInfo = append(playersInfo, NewPlayerInfo(player))
 	}
 	rmsg.Data = playersInfo
 
@@ -970,11 +1109,7 @@ func (event *MafiaEvent) Process(players *Players, history *EventHistory) error
 		if player.Role() == ROLE_MAFIA {
 			continue
 		}
-		playerInfo := map[string]interface{}{
-			"username": player.Name(),
-			"id":       player.Id(),
-		}
-		playersInfo = append(playersInfo, playerInfo)
+		playersInfo = append(playersInfo, NewPlayerInfo(player))
 	}
 
 	response := NewEventMessage(event, ACTION_PLAYERS)
@@ -998,8 +1133,7 @@ func (event *MafiaEvent) VoteAction(players *Players, history *EventHistory, pla
 		return fmt.Errorf(err)
 	}
 
-	voteId := int(msg.Data.(float64))
-	vote := players.FindOneById(voteId)
+	vote := players.FindTarget(msg.Data)
 
 	if vote == nil {
 		rmsg := NewEventMessage(event, ACTION_CHOICE)
@@ -1016,6 +1150,15 @@ func (event *MafiaEvent) VoteAction(players *Players, history *EventHistory, pla
 		return nil
 	}
 
+	return event.chooseCandidate()
+}
+
+// Timeout chooses the candidate from the votes given so far.
+func (event *MafiaEvent) Timeout(players *Players, history *EventHistory) error {
+	return event.chooseCandidate()
+}
+
+func (event *MafiaEvent) chooseCandidate() error {
 	maxVotes := 0
 	votes := make(map[*Player]int, 0)
 	for _, vote := range event.Votes() {
@@ -1059,6 +1202,7 @@ NightResultEvent
 type NightResultEvent struct {
 	Event
 	AcceptEvent
+	killed *Player
 }
 
 func NewNightResultEvent(iter int) *NightResultEvent {
@@ -1076,7 +1220,7 @@ func (event *NightResultEvent) Process(players *Players, history *EventHistory)
 	event.status = IN_PROCESS
 
 	if event.Iteration() == 1 {
-		log.Debugf("event has iteration %d", event.Iteration())
+		players.Log().Debug("No night result on the first iteration")
 		event.SetStatus(PROCESSED)
 		return nil
 	}
@@ -1132,11 +1276,18 @@ func (event *NightResultEvent) Process(players *Players, history *EventHistory)
 		player.SendMessage(rmsg)
 	}
 
+	event.killed = mafiaCandidate
 	mafiaCandidate.SetOut(true)
+	mafiaCandidate.Log().Info("Player is killed by mafia")
 
 	return nil
 }
 
+// Killed is the player killed this night, nil when the mafia killed no one.
+func (event *NightResultEvent) Killed() *Player {
+	return event.killed
+}
+
 func (event *NightResultEvent) AcceptAction(players *Players, history *EventHistory, player *Player, msg *Message) error {
 	event.AddAccepted(player)
 
@@ -1180,11 +1331,7 @@ func (event *SheriffEvent) Process(players *Players, history *EventHistory) erro
 		if player.Role() == ROLE_SHERIFF {
 			continue
 		}
-		playerInfo := map[string]interface{}{
-			"username": player.Name(),
-			"id":       player.Id(),
-		}
-		playersInfo = append(playersInfo, playerInfo)
+		playersInfo = append(playersInfo, NewPlayerInfo(player))
 	}
 
 	response := NewEventMessage(event, ACTION_PLAYERS)
@@ -1206,8 +1353,7 @@ func (event *SheriffEvent) ChoiceAction(players *Players, history *EventHistory,
 		return fmt.Errorf(err)
 	}
 
-	choiceId := int(msg.Data.(float64))
-	choice := players.FindOneById(choiceId)
+	choice := players.FindTarget(msg.Data)
 
 	if choice == nil {
 		rmsg := NewEventMessage(event, ACTION_CHOICE)
@@ -1286,7 +1432,8 @@ GameOverEvent
 type GameOverEvent struct {
 	Event
 	AcceptEvent
-	winner int
+	winner  int
+	rematch bool
 }
 
 func NewGameOverEvent(iter int, winner int) *GameOverEvent {
@@ -1296,6 +1443,7 @@ func NewGameOverEvent(iter int, winner int) *GameOverEvent {
 	e.event = EVENT_GAME_OVER
 	e.iteration = iter
 	e.AddAction(ACTION_ACCEPT, e.AcceptAction)
+	e.AddAction(ACTION_REMATCH, e.RematchAction)
 	e.winner = winner
 	return e
 }
@@ -1306,8 +1454,12 @@ func (event *GameOverEvent) Process(players *Players, history *EventHistory) err
 	rmsg := NewEventMessage(event, ACTION_OVER)
 	rmsg.Data = event.winner
 
+	summary := NewEventMessage(event, ACTION_SUMMARY)
+	summary.Data = NewGameSummary(event.winner, players, history)
+
 	for _, player := range players.FindAllWithOut() {
 		player.SendMessage(rmsg)
+		player.SendMessage(summary)
 	}
 
 	return nil
@@ -1322,3 +1474,25 @@ func (event *GameOverEvent) AcceptAction(players *Players, history *EventHistory
 
 	return nil
 }
+
+// RematchAction asks for a rematch, the other players are told who asked.
+// The rematch starts when the master sends it, the game returns to the lobby in SetNextEvent.
+func (event *GameOverEvent) RematchAction(players *Players, history *EventHistory, player *Player, msg *Message) error {
+	rmsg := NewEventMessage(event, ACTION_REMATCH)
+	rmsg.Data = map[string]interface{}{"player": player.Name(), "confirmed": player.Master()}
+
+	for _, pl := range players.FindAllWithOut() {
+		pl.SendMessage(rmsg)
+	}
+
+	if player.Master() {
+		event.rematch = true
+		event.SetStatus(PROCESSED)
+	}
+
+	return nil
+}
+
+func (event *GameOverEvent) Rematch() bool {
+	return event.rematch
+}
@@ -1,40 +1,364 @@
 package main
 
 import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	log "github.com/sirupsen/logrus"
 )
 
 var Games = make(map[int]*Game, 0)
+var GamesMutex sync.RWMutex
+
+func AddGame(game *Game) {
+	GamesCreated.Inc()
+	GamesMutex.Lock()
+	defer GamesMutex.Unlock()
+	Games[game.Id] = game
+}
+
+// RemoveGame removes game from the registry, a rebuilt copy with the same id leaves the registered game in place.
+func RemoveGame(game *Game) {
+	GamesMutex.Lock()
+	defer GamesMutex.Unlock()
+	if Games[game.Id] == game {
+		delete(Games, game.Id)
+	}
+}
+
+func FindGame(id int) (*Game, bool) {
+	GamesMutex.RLock()
+	defer GamesMutex.RUnlock()
+	game, ok := Games[id]
+	return game, ok
+}
+
+func FindGames() []*Game {
+	GamesMutex.RLock()
+	defer GamesMutex.RUnlock()
+	games := make([]*Game, 0, len(Games))
+	for _, game := range Games {
+		games = append(games, game)
+	}
+	return games
+}
+
+// GAME_ID_SPACE bounds game ids, CanCreateGame keeps the registry under half of it so free ids are easy to draw.
+const GAME_ID_SPACE = 1000000
+
+// NewGameId returns a random id that is not used by a running game.
+func NewGameId() int {
+	GamesMutex.RLock()
+	defer GamesMutex.RUnlock()
+	for {
+		id := rand.Intn(GAME_ID_SPACE)
+		if _, ok := Games[id]; !ok {
+			return id
+		}
+	}
+}
+
+const VISIBILITY_PUBLIC = "public"
+const VISIBILITY_PRIVATE = "private"
+
+// CleanupGames removes lobbies without activity for lobbyTTL, started games without activity for lobbyTTL
+// whose players have all disconnected, and games finished more than retention ago.
+func CleanupGames(lobbyTTL time.Duration, retention time.Duration) {
+	for _, game := range FindGames() {
+		switch {
+		case game.isLobby() && time.Since(game.UpdatedAt) > lobbyTTL:
+			game.Log().Info("Remove idle lobby")
+			game.Abort()
+			RemoveGame(game)
+		case game.FinishedAt.IsZero() && time.Since(game.UpdatedAt) > lobbyTTL && game.isAbandoned():
+			game.Log().Info("Remove abandoned game")
+			game.Abort()
+			RemoveGame(game)
+		case !game.FinishedAt.IsZero() && time.Since(game.FinishedAt) > retention:
+			game.Log().Info("Remove finished game")
+			game.Stop()
+			RemoveGame(game)
+		}
+	}
+}
+
+func GamesGC(every time.Duration, lobbyTTL time.Duration, retention time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		CleanupGames(lobbyTTL, retention)
+	}
+}
+
+// GamesReachable reports whether the game registry can be locked within timeout.
+func GamesReachable(timeout time.Duration) bool {
+	locked := make(chan struct{})
+	go func() {
+		GamesMutex.RLock()
+		GamesMutex.RUnlock()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// CanCreateGame reports whether the max_games limit allows one more game.
+func CanCreateGame() bool {
+	GamesMutex.RLock()
+	defer GamesMutex.RUnlock()
+
+	if len(Games) >= GAME_ID_SPACE/2 {
+		return false
+	}
+
+	return Conf.MaxGames == 0 || len(Games) < Conf.MaxGames
+}
+
+// RoleSetup describes which roles are dealt, see RoleSetup.Deal.
+type RoleSetup struct {
+	MafiaDivisor int  `json:"mafia_divisor" mapstructure:"mafia_divisor" yaml:"mafia_divisor"`
+	Doctor       bool `json:"doctor" mapstructure:"doctor" yaml:"doctor"`
+	Girl         bool `json:"girl" mapstructure:"girl" yaml:"girl"`
+	Sheriff      bool `json:"sheriff" mapstructure:"sheriff" yaml:"sheriff"`
+}
+
+func DefaultRoleSetup() RoleSetup {
+	return RoleSetup{
+		MafiaDivisor: 3,
+		Doctor:       true,
+		Girl:         true,
+		Sheriff:      true,
+	}
+}
+
+func (setup RoleSetup) Validate() error {
+	if setup.MafiaDivisor < 2 {
+		return fmt.Errorf("mafia_divisor must be at least 2")
+	}
+
+	return nil
+}
+
+type GameSettings struct {
+	MaxPlayers   int       `json:"max_players"`
+	Visibility   string    `json:"visibility"`
+	Roles        RoleSetup `json:"roles"`
+	ShuffleSeats bool      `json:"shuffle_seats"`
+}
+
+func DefaultGameSettings() GameSettings {
+	return GameSettings{
+		MaxPlayers: Conf.MaxPlayers,
+		Visibility: VISIBILITY_PRIVATE,
+		Roles:      Conf.Roles,
+	}
+}
+
+// Apply reads settings sent with the create action, unknown fields are ignored.
+func (settings *GameSettings) Apply(data map[string]interface{}) error {
+	if maxPlayers, ok := data["max_players"].(float64); ok {
+		settings.MaxPlayers = int(maxPlayers)
+	}
+
+	if visibility, ok := data["visibility"].(string); ok {
+		settings.Visibility = visibility
+	}
+
+	if shuffleSeats, ok := data["shuffle_seats"].(bool); ok {
+		settings.ShuffleSeats = shuffleSeats
+	}
+
+	return settings.Validate()
+}
+
+func (settings GameSettings) Validate() error {
+	if settings.MaxPlayers != 0 && settings.MaxPlayers < 3 {
+		return fmt.Errorf("max_players must be 0 or at least 3")
+	}
+
+	if Conf.MaxPlayers != 0 && (settings.MaxPlayers == 0 || settings.MaxPlayers > Conf.MaxPlayers) {
+		return fmt.Errorf("max_players must be between 3 and %d", Conf.MaxPlayers)
+	}
+
+	if err := settings.Roles.Validate(); err != nil {
+		return err
+	}
+
+	if settings.Visibility != VISIBILITY_PUBLIC && settings.Visibility != VISIBILITY_PRIVATE {
+		return fmt.Errorf("visibility must be %s or %s", VISIBILITY_PUBLIC, VISIBILITY_PRIVATE)
+	}
+
+	return nil
+}
 
 type Game struct {
 	Id            int
+	Settings      GameSettings
 	Players       *Players
 	EventsQueue   *EventQueue
 	EventsHistory *EventHistory
 	Event         IEvent
 	Iteration     int
 	Winner        int
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	FinishedAt    time.Time
+	EventStarted  time.Time
+	Journal       *Journal
+	Seed          int64
+	Previous      *FinishedGame
+	rng           *rand.Rand
+	loopLag       int64
+	mutex         sync.Mutex
+	done          chan struct{}
+	stopOnce      sync.Once
+}
+
+// FinishedGame keeps the summary and journal of a game that is over when the table starts a rematch,
+// so its replay and summary are served until the next game is over.
+type FinishedGame struct {
+	FinishedAt time.Time
+	Summary    GameSummary
+	Entries    []*JournalEntry
 }
 
 func NewGame() *Game {
-	return &Game{
-		Id:            rand.Intn(99),
+	game := &Game{
+		Id:            NewGameId(),
+		Settings:      DefaultGameSettings(),
 		Players:       NewPlayers(),
 		EventsQueue:   NewEventQueue(),
 		EventsHistory: NewEventHistory(),
 		Iteration:     1,
 		Event:         NewGameEvent(),
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
+		done:          make(chan struct{}),
 	}
+	game.Journal = NewJournal(game)
+	game.SetSeed(NewGameSeed())
+	return game
+}
+
+// NewGameSeed draws a seed from crypto/rand, so seeds of games created together differ.
+func NewGameSeed() int64 {
+	b := make([]byte, 8)
+	if _, err := cryptorand.Read(b); err != nil {
+		return time.Now().UnixNano()
+	}
+	return int64(binary.BigEndian.Uint64(b) >> 1)
+}
+
+// SetSeed resets the game RNG, every random choice of the game (roles, shuffled seats) is drawn from it,
+// so a game started with the same seed and the same inputs plays the same.
+func (game *Game) SetSeed(seed int64) {
+	game.Seed = seed
+	game.rng = rand.New(rand.NewSource(seed))
+}
+
+// rematch returns the table to the lobby with the same players, master and settings and a new seed.
+func (game *Game) rematch() {
+	game.Log().Info("Rematch")
+
+	game.Previous = &FinishedGame{
+		FinishedAt: game.FinishedAt,
+		Summary:    NewGameSummary(game.Winner, game.Players, game.EventsHistory),
+		Entries:    game.Journal.Entries(),
+	}
+
+	game.EventsQueue.Clear()
+	game.EventsHistory = NewEventHistory()
+	game.Iteration = 1
+	game.Winner = 0
+	game.FinishedAt = time.Time{}
+	game.SetSeed(NewGameSeed())
+
+	for _, player := range game.Players.FindAllWithOut() {
+		player.SetOut(false)
+		player.SetRole(0)
+	}
+
+	game.Event = NewGameEvent()
+}
+
+func (game *Game) Rand() *rand.Rand {
+	return game.rng
 }
 
 func (game *Game) Run() {
+	game.Journal.Game()
 	go game.EventLoop()
 }
 
+// Stop ends the event loop, the game does not accept actions anymore.
+func (game *Game) Stop() {
+	game.stopOnce.Do(func() {
+		close(game.done)
+		game.Journal.Close()
+	})
+}
+
+func (game *Game) isStopped() bool {
+	select {
+	case <-game.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Abort stops the game and tells every player about it.
+func (game *Game) Abort() {
+	game.mutex.Lock()
+	game.Stop()
+
+	rmsg := NewEventMessage(game.Event, ACTION_ABORT)
+	for _, player := range game.Players.FindAllWithOut() {
+		player.SendMessage(rmsg)
+	}
+	game.mutex.Unlock()
+
+	Lobby.Broadcast()
+}
+
+// LoopLag is how late the event loop handled its last tick.
+func (game *Game) LoopLag() time.Duration {
+	return time.Duration(atomic.LoadInt64(&game.loopLag))
+}
+
+// Touch marks activity in the game, idle lobbies are removed by the janitor.
+func (game *Game) Touch() {
+	game.UpdatedAt = time.Now()
+}
+
+// isLobby reports whether the game still waits for players.
+func (game *Game) isLobby() bool {
+	return !game.isStopped() && game.Event.Name() == EVENT_GAME && game.Event.Status() != PROCESSED
+}
+
+// isAbandoned reports whether no player still in the game has an open transport.
+func (game *Game) isAbandoned() bool {
+	for _, player := range game.Players.FindAll() {
+		if Clients.Has(player) {
+			return false
+		}
+	}
+	return true
+}
+
+func (game *Game) isFull() bool {
+	return game.Settings.MaxPlayers != 0 && len(game.Players.FindAll()) >= game.Settings.MaxPlayers
+}
+
 func (game *Game) isOver() bool {
 
 	if game.Event.Name() == EVENT_GAME ||
@@ -63,6 +387,14 @@ func (game *Game) isOver() bool {
 
 func (game *Game) SetNextEvent() error {
 
+	if over, ok := game.Event.(*GameOverEvent); ok && over.Rematch() {
+		game.rematch()
+		game.Journal.Event(game.Event, map[string]interface{}{"rematch": true, "seed": strconv.FormatInt(game.Seed, 10)})
+		game.Event.(*GameEvent).sendPlayersInfo(game.Players)
+		Lobby.Broadcast()
+		return nil
+	}
+
 	if game.EventsQueue.Len() == 0 {
 		game.initEventQueue()
 	}
@@ -72,6 +404,18 @@ func (game *Game) SetNextEvent() error {
 	if event != nil {
 		game.EventsHistory.Push(game.Event)
 		game.Event = event
+		switch event.Name() {
+		case EVENT_GAME_START:
+			game.Log().WithField("seed", game.Seed).Debug("Game started")
+			game.Journal.Event(event, map[string]interface{}{"seed": strconv.FormatInt(game.Seed, 10)})
+		case EVENT_GAME_OVER:
+			game.Journal.Event(event, map[string]interface{}{"winner": game.Winner})
+		default:
+			game.Journal.Event(event, nil)
+		}
+		if event.Name() == EVENT_GAME_OVER && game.FinishedAt.IsZero() {
+			game.FinishedAt = time.Now()
+		}
 		return nil
 	}
 
@@ -94,7 +438,7 @@ func (game *Game) initEventQueue() error {
 			return nil
 		case EVENT_GAME_START:
 			queue.Push(NewAcceptEvent(game.Iteration, EVENT_GREET_CITIZENS, ACTION_START))
-			queue.Push(NewGreetCitizensEvent(game.Iteration))
+			queue.Push(NewGreetCitizensEvent(game.Iteration, game.Settings.Roles, game.Rand()))
 			queue.Push(NewAcceptEvent(game.Iteration, EVENT_GREET_CITIZENS, ACTION_END))
 			return nil
 		case EVENT_GREET_CITIZENS:
@@ -170,19 +514,85 @@ func (game *Game) initEventQueue() error {
 	return nil
 }
 
+// eventTimeout returns how long the current event waits for players with timeouts, zero waits forever.
+func (game *Game) eventTimeout(timeouts TimeoutsConfig) time.Duration {
+	switch game.Event.(type) {
+	case *GameEvent, *GameOverEvent:
+		return 0
+	case IEventVote:
+		return timeouts.Vote
+	case IEventChoice:
+		return timeouts.Choice
+	}
+
+	return timeouts.Accept
+}
+
+func (game *Game) timeoutEvent() {
+	game.Log().Info("Event timed out")
+	game.Journal.Event(game.Event, map[string]interface{}{"timeout": true})
+
+	if event, ok := game.Event.(ITimeoutEvent); ok {
+		err := event.Timeout(game.Players, game.EventsHistory)
+		if err != nil {
+			game.Log().Warningf("Timeout err: %v", err)
+		}
+	}
+
+	game.Event.SetStatus(PROCESSED)
+}
+
 func (game *Game) EventLoop() {
 	ticker := time.NewTicker(1 * time.Millisecond)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-game.done:
+			return
+		case tick := <-ticker.C:
+			atomic.StoreInt64(&game.loopLag, int64(time.Since(tick)))
+		}
+
+		// actions of players wait while the loop moves the game on, a game stopped meanwhile is left alone
+		game.mutex.Lock()
+		if game.isStopped() {
+			game.mutex.Unlock()
+			return
+		}
+
 		switch game.Event.Status() {
 		case NOT_IN_PROCESS:
+			game.EventStarted = time.Now()
 			err := game.Event.Process(game.Players, game.EventsHistory)
 			if err != nil {
-				log.Warningf("Event: %s, err: %v", game.Event.Name(), err)
+				game.Log().Warningf("Process err: %v", err)
+			}
+			break
+		case IN_PROCESS:
+			timeout := game.eventTimeout(Conf.Timeouts)
+			if timeout != 0 && time.Since(game.EventStarted) > timeout {
+				game.timeoutEvent()
 			}
 			break
 		case PROCESSED:
-			game.SetNextEvent()
+			PhaseDuration.WithLabelValues(game.Event.Name()).Observe(time.Since(game.EventStarted).Seconds())
+			finished := !game.FinishedAt.IsZero()
+			err := game.SetNextEvent()
+			if err != nil {
+				game.Log().Errorf("Next event err: %v", err)
+				break
+			}
+			if !finished && !game.FinishedAt.IsZero() {
+				GamesFinished.Inc()
+				GameWinners.WithLabelValues(WinnerTeam(game.Winner)).Inc()
+				if err := Accounts.RecordGame(game); err != nil {
+					game.Log().Errorf("Record stats err: %v", err)
+				}
+			}
+			game.Log().Debug("Next event")
 			break
 		}
+
+		game.mutex.Unlock()
 	}
 }
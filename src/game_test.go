@@ -11,17 +11,19 @@ import (
 func (p *Player) Run(t *testing.T) {
 	go func() {
 		for {
-			select {
-			case message := <-p.send:
-				fmt.Sprint(message)
+			item, ok := p.send.Wait()
+			if !ok {
+				return
 			}
+			fmt.Sprint(item.Data)
 		}
 	}()
 }
 
 func (p *Player) ReceiveMessage(t *testing.T, event string, action string) bool {
 	msg := &Message{}
-	json.Unmarshal(<-p.send, msg)
+	item, _ := p.send.Wait()
+	json.Unmarshal(item.Data, msg)
 
 	if msg.Event != event {
 		t.Errorf("Player receive wrong message event, {id: %d, rcv: %s, must: %s}", p.Id(), msg.Event, event)
@@ -36,6 +38,68 @@ func (p *Player) ReceiveMessage(t *testing.T, event string, action string) bool
 	return true
 }
 
+// waitFor polls cond every millisecond until it holds or a second passes.
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// locked runs fn while the event loop of game is between steps.
+func locked(game *Game, fn func()) {
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+	fn()
+}
+
+// currentEvent reads the event of a running game.
+func currentEvent(game *Game) (event IEvent, status int) {
+	locked(game, func() {
+		event, status = game.Event, game.Event.Status()
+	})
+	return event, status
+}
+
+// waitForPlayers waits until the event loop has processed the current event and waits for players.
+func waitForPlayers(game *Game) bool {
+	return waitFor(func() bool {
+		event, status := currentEvent(game)
+		if status != IN_PROCESS {
+			return false
+		}
+		time.Sleep(2 * time.Millisecond)
+		current, status := currentEvent(game)
+		return current == event && status == IN_PROCESS
+	})
+}
+
+// nextEvent finishes the current event and waits until the game waits for players again.
+func nextEvent(game *Game) bool {
+	event, _ := currentEvent(game)
+	waitFor(func() bool { _, status := currentEvent(game); return status != NOT_IN_PROCESS })
+	game.mutex.Lock()
+	event.SetStatus(PROCESSED)
+	game.mutex.Unlock()
+	waitFor(func() bool { current, _ := currentEvent(game); return current != event })
+	return waitForPlayers(game)
+}
+
+// stopGame stops and removes game when the test ends. The loop does not step a stopped game,
+// so Conf can be restored by cleanups registered before.
+func stopGame(t *testing.T, game *Game) {
+	t.Cleanup(func() {
+		game.mutex.Lock()
+		game.Stop()
+		game.mutex.Unlock()
+		RemoveGame(game)
+	})
+}
+
 type EventChecker struct {
 	Players       []*Player
 	T             *testing.T
@@ -45,6 +109,31 @@ type EventChecker struct {
 	Data          interface{}
 }
 
+// drain drops the queued messages of the checked step, the sent actions and their answers. The loop may
+// already have sent the next event, its messages are queued again in order.
+func (e *EventChecker) drain(player *Player) {
+	game := player.Game()
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+
+	kept := make([]*Outbound, 0)
+	for {
+		item, ok := player.send.Pop()
+		if !ok {
+			break
+		}
+		step := item.Message.Event == e.Event && (item.Message.Action == e.ActionSend || item.Message.Action == e.ActionReceive)
+		if len(kept) == 0 && step {
+			continue
+		}
+		kept = append(kept, item)
+	}
+
+	for _, item := range kept {
+		player.send.Push(item)
+	}
+}
+
 func (e *EventChecker) Check() {
 	for _, player := range e.Players {
 		if !player.ReceiveMessage(e.T, e.Event, e.ActionSend) {
@@ -59,26 +148,12 @@ func (e *EventChecker) Check() {
 			Data:   e.Data,
 		}
 
-		for {
-
-			if len(player.send) == 0 {
-				break
-			}
-
-			<-player.send
-		}
+		e.drain(player)
 
 		player.OnMessage(msg)
 
 		for _, rcvPlayer := range e.Players {
-			for {
-
-				if len(rcvPlayer.send) == 0 {
-					break
-				}
-
-				<-rcvPlayer.send
-			}
+			e.drain(rcvPlayer)
 		}
 	}
 
@@ -108,13 +183,74 @@ func TestGameCreate(t *testing.T) {
 		t.Errorf("Player has not game")
 		return
 	}
+	stopGame(t, player.Game())
+}
+
+func TestGameCreateRejected(t *testing.T) {
+	games := len(FindGames())
+
+	for _, data := range []map[string]interface{}{
+		{"username": "anton", "visibility": "secret"},
+		{"username": "anton", "visibility": "public", "color": "red"},
+	} {
+		player := NewPlayer()
+		player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: data})
+
+		item, _ := player.send.Pop()
+		if item.Message.Status != STATUS_ERR || player.Game() != nil || player.Master() {
+			t.Errorf("Create must be refused %v", data)
+		}
+	}
+
+	if len(FindGames()) != games {
+		t.Errorf("Refused create must not leave a game behind")
+	}
+}
+
+func TestGameJoinRejected(t *testing.T) {
+	master := NewPlayer()
+	master.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: map[string]interface{}{"username": "master", "max_players": float64(3)}})
+	game := master.Game()
+	stopGame(t, game)
+
+	join := func(player *Player, data map[string]interface{}) {
+		data["game"] = float64(game.Id)
+		player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_JOIN, Data: data})
+	}
+
+	join(NewPlayer(), map[string]interface{}{"username": "anton"})
+	join(NewPlayer(), map[string]interface{}{"username": "boris"})
+
+	for _, data := range []map[string]interface{}{
+		{"username": "master2"},
+		{"username": "anton"},
+		{"username": "boris2", "color": "red"},
+	} {
+		if data["username"] != "master2" {
+			game.Settings.MaxPlayers = 4
+		}
+
+		player := NewPlayer()
+		join(player, data)
+
+		item, _ := player.send.Pop()
+		if item.Message.Status != STATUS_ERR || player.Game() != nil {
+			t.Errorf("Join must be refused and leave the player without a game %v", data)
+		}
+
+		player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: map[string]interface{}{"username": "own"}})
+		if own := player.Game(); own == nil || !player.Master() {
+			t.Errorf("Refused player must be able to create a game %v", data)
+		} else {
+			stopGame(t, own)
+		}
+	}
 }
 
 func TestGameJoin(t *testing.T) {
 	game := NewGame()
-	game.Run()
-
-	Games[game.Id] = game
+	AddGame(game)
+	stopGame(t, game)
 
 	player := NewPlayer()
 	player.SetName("anton")
@@ -122,6 +258,7 @@ func TestGameJoin(t *testing.T) {
 	player.Run(t)
 
 	game.Players.Add(player)
+	game.Run()
 
 	player2 := NewPlayer()
 	player2.Run(t)
@@ -136,11 +273,49 @@ func TestGameJoin(t *testing.T) {
 	player2.OnMessage(msg)
 }
 
+func TestGameLeave(t *testing.T) {
+	game := NewGame()
+	AddGame(game)
+	stopGame(t, game)
+
+	master := NewPlayer()
+	master.SetName("anton")
+	master.SetMaster(true)
+	master.SetGame(game)
+	master.Run(t)
+	game.Players.Add(master)
+
+	player := NewPlayer()
+	player.SetName("anton2")
+	player.SetGame(game)
+	player.Run(t)
+	game.Players.Add(player)
+	game.Run()
+
+	master.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_LEAVE})
+
+	if master.Game() != nil || master.Master() {
+		t.Errorf("Player is still in game")
+		return
+	}
+
+	if !player.Master() {
+		t.Errorf("Master has not migrated")
+		return
+	}
+
+	player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_LEAVE})
+
+	if _, ok := FindGame(game.Id); ok {
+		t.Errorf("Empty game was not removed")
+	}
+}
+
 func TestAcceptEvent(t *testing.T) {
 	game := NewGame()
 	game.Event = NewAcceptEvent(game.Iteration, EVENT_GREET_CITIZENS, ACTION_END)
-	game.Run()
-	Games[game.Id] = game
+	AddGame(game)
+	stopGame(t, game)
 
 	mafia := NewPlayer()
 	mafia.Run(t)
@@ -172,6 +347,9 @@ func TestAcceptEvent(t *testing.T) {
 	sheriff.SetRole(ROLE_SHERIFF)
 	game.Players.Add(sheriff)
 
+	game.Run()
+	waitForPlayers(game)
+
 	msg := NewEventMessage(game.Event, ACTION_END)
 	mafia.OnMessage(msg)
 	citizen.OnMessage(msg)
@@ -179,9 +357,7 @@ func TestAcceptEvent(t *testing.T) {
 	girl.OnMessage(msg)
 	sheriff.OnMessage(msg)
 
-	time.Sleep(10 * time.Millisecond)
-
-	if game.Event.Name() != EVENT_NIGHT {
+	if !waitFor(func() bool { event, _ := currentEvent(game); return event.Name() == EVENT_NIGHT }) {
 		t.Errorf("Game has wrong event")
 	}
 }
@@ -190,8 +366,8 @@ func TestMafiaResultEvent(t *testing.T) {
 	game := NewGame()
 	game.Iteration = 2
 	game.Event = NewMafiaEvent(game.Iteration)
-	game.Run()
-	Games[game.Id] = game
+	AddGame(game)
+	stopGame(t, game)
 
 	mafia := NewPlayer()
 	mafia.Run(t)
@@ -205,18 +381,20 @@ func TestMafiaResultEvent(t *testing.T) {
 	citizen.SetRole(ROLE_CITIZEN)
 	game.Players.Add(citizen)
 
+	game.Run()
+	waitForPlayers(game)
+
 	msg := NewEventMessage(game.Event, ACTION_VOTE)
 	msg.Data = float64(citizen.Id())
 	mafia.OnMessage(msg)
 
-	time.Sleep(5 * time.Millisecond)
-	if game.Event.Name() != EVENT_DAY {
-		t.Errorf("Game has wrong event: %s, must be: %s, iteration: %d", game.Event.Name(), EVENT_DAY, game.Event.Iteration())
+	if !waitFor(func() bool { event, _ := currentEvent(game); return event.Name() == EVENT_DAY }) {
+		event, _ := currentEvent(game)
+		t.Errorf("Game has wrong event: %s, must be: %s, iteration: %d", event.Name(), EVENT_DAY, event.Iteration())
 		return
 	}
 
-	game.Event.SetStatus(PROCESSED)
-	time.Sleep(5 * time.Millisecond)
+	nextEvent(game)
 
 	if game.Event.Name() != EVENT_NIGHT_RESULT {
 		t.Errorf("Game has wrong event: %s, must be: %s, iteration: %d", game.Event.Name(), EVENT_NIGHT_RESULT, game.Event.Iteration())
@@ -229,9 +407,20 @@ func TestMafiaResultEvent(t *testing.T) {
 	}
 }
 
+func TestMafiaTie(t *testing.T) {
+	event := NewMafiaEvent(2)
+	mafia, mafia2, citizen, citizen2 := NewPlayer(), NewPlayer(), NewPlayer(), NewPlayer()
+
+	event.AddVoted(mafia, citizen)
+	event.AddVoted(mafia2, citizen2)
+
+	if err := event.chooseCandidate(); err == nil || event.Candidate() != nil || event.Status() != PROCESSED {
+		t.Errorf("Tied mafia vote must kill nobody")
+	}
+}
+
 func TestGameEventLoopFirstLoop(t *testing.T) {
 	game := NewGame()
-	game.Run()
 	game.Event = NewGameEvent()
 
 	for i := 0; i < 10; i++ {
@@ -241,6 +430,9 @@ func TestGameEventLoopFirstLoop(t *testing.T) {
 		game.Players.Add(player)
 	}
 
+	game.Run()
+	stopGame(t, game)
+
 	events := []string{
 		EVENT_GAME_START,     //start
 		EVENT_GREET_CITIZENS, //start
@@ -261,9 +453,9 @@ func TestGameEventLoopFirstLoop(t *testing.T) {
 		EVENT_MAFIA, //end
 	}
 
+	waitForPlayers(game)
 	for _, eventName := range events {
-		game.Event.SetStatus(PROCESSED)
-		time.Sleep(2 * time.Millisecond)
+		nextEvent(game)
 		t.Logf("Check %s, current %s, iteration %d", eventName, game.Event.Name(), game.Event.Iteration())
 		if game.Event.Name() != eventName {
 			t.Errorf("Event has wrong name %s", game.Event.Name())
@@ -276,8 +468,6 @@ func TestGameEventLoopSecondIteration(t *testing.T) {
 
 	game := NewGame()
 	game.Iteration = 2
-	game.Run()
-	game.Event = NewGameEvent()
 
 	mafia := NewPlayer()
 	mafia.Run(t)
@@ -333,9 +523,11 @@ func TestGameEventLoopSecondIteration(t *testing.T) {
 	}
 
 	game.Event = NewAcceptEvent(game.Iteration, EVENT_NIGHT, ACTION_ACCEPT)
+	game.Run()
+	stopGame(t, game)
+	waitForPlayers(game)
 	for _, eventName := range events {
-		game.Event.SetStatus(PROCESSED)
-		time.Sleep(10 * time.Millisecond)
+		nextEvent(game)
 		t.Logf("Check: %s, current: %s, iteration: %d", eventName, game.Event.Name(), game.Event.Iteration())
 		if game.Event.Name() != eventName {
 			t.Errorf("Event has wrong name, check %s, current: %s", eventName, game.Event.Name())
@@ -367,6 +559,7 @@ func TestGameEvents(t *testing.T) {
 		t.Errorf("Player has no game")
 		return
 	}
+	stopGame(t, playerMaster.Game())
 
 	for i := 0; i < 100; i++ {
 		player := NewPlayer()
@@ -608,6 +801,7 @@ func TestGameOver(t *testing.T) {
 	citizen.game = game
 
 	game.Run()
+	stopGame(t, game)
 
 	ch := &EventChecker{}
 	ch.T = t
@@ -622,19 +816,21 @@ func TestGameOver(t *testing.T) {
 	ch.Data = float64(candidate.Id())
 	ch.Check()
 
-	ch.Players = game.Players.FindAll()
+	locked(game, func() { ch.Players = game.Players.FindAll() })
 	ch.Event = EVENT_DAY
 	ch.ActionSend = ACTION_START
 	ch.ActionReceive = ACTION_START
 	ch.Check()
 
-	ch.Players = game.Players.FindAll()
+	locked(game, func() { ch.Players = game.Players.FindAll() })
 	ch.Event = EVENT_NIGHT_RESULT
 	ch.ActionSend = ACTION_OUT
 	ch.ActionReceive = ACTION_ACCEPT
 	ch.Check()
 
-	if !game.isOver() {
+	over := false
+	locked(game, func() { over = game.isOver() })
+	if !over {
 		t.Errorf("Game is not over")
 		return
 	}
@@ -659,8 +855,9 @@ func TestReconnect(t *testing.T) {
 	game.Players.Add(citizen)
 	citizen.game = game
 
-	Games[game.Id] = game
+	AddGame(game)
 	game.Run()
+	stopGame(t, game)
 
 	ch := &EventChecker{}
 	ch.T = t
@@ -671,6 +868,14 @@ func TestReconnect(t *testing.T) {
 	ch.ActionReceive = ACTION_START
 	ch.Check()
 
+	waitFor(func() bool {
+		sent := false
+		locked(game, func() {
+			sent = citizen.lastSendMessage != nil && citizen.lastSendMessage.Event == EVENT_NIGHT_RESULT
+		})
+		return sent
+	})
+
 	newCitizen := NewPlayer()
 
 	msg := &Message{
@@ -685,3 +890,218 @@ func TestReconnect(t *testing.T) {
 		return
 	}
 }
+
+func TestGameSeed(t *testing.T) {
+	deal := func(seed int64) []int {
+		game := NewGame()
+		game.SetSeed(seed)
+		for i := 0; i < 8; i++ {
+			player := NewPlayer()
+			player.SetGame(game)
+			game.Players.Add(player)
+		}
+
+		NewGreetCitizensEvent(game.Iteration, DefaultRoleSetup(), game.Rand()).Process(game.Players, game.EventsHistory)
+
+		roles := make([]int, 0)
+		for _, player := range game.Players.FindAll() {
+			roles = append(roles, player.Role())
+		}
+		return roles
+	}
+
+	first := fmt.Sprint(deal(42))
+	second := fmt.Sprint(deal(42))
+	if first != second {
+		t.Errorf("Games with the same seed dealt different roles %s and %s", first, second)
+	}
+}
+
+func TestSeats(t *testing.T) {
+	seat := func(seed int64, shuffle bool) *Game {
+		game := NewGame()
+		game.SetSeed(seed)
+		game.Settings.ShuffleSeats = shuffle
+		for i := 0; i < 6; i++ {
+			player := NewPlayer()
+			player.SetName(fmt.Sprintf("player%d", i))
+			player.SetMaster(i == 0)
+			player.SetGame(game)
+			game.Players.Add(player)
+		}
+
+		master := game.Players.FindMaster()
+		game.Event.(*GameEvent).StartAction(game.Players, game.EventsHistory, master, &Message{Event: EVENT_GAME, Action: ACTION_START})
+		return game
+	}
+
+	names := func(game *Game) string {
+		names := make([]string, 0)
+		for _, player := range game.Players.FindAll() {
+			names = append(names, fmt.Sprintf("%d:%s", player.Seat(), player.Name()))
+		}
+		return fmt.Sprint(names)
+	}
+
+	game := seat(42, false)
+	if names(game) != "[1:player0 2:player1 3:player2 4:player3 5:player4 6:player5]" {
+		t.Errorf("Seats must follow join order %s", names(game))
+	}
+
+	if shuffled := names(seat(42, true)); shuffled != names(seat(42, true)) {
+		t.Errorf("Games with the same seed got different seats %s", shuffled)
+	}
+
+	Games[game.Id] = game
+	defer RemoveGame(game)
+
+	old := game.Players.FindOneBySeat(3)
+	player := NewPlayer()
+	player.OnMessage(&Message{
+		Event:  EVENT_GAME,
+		Action: ACTION_RECONNECT,
+		Data:   map[string]interface{}{"game": float64(game.Id), "player": float64(old.Id())},
+	})
+
+	if player.Seat() != 3 || game.Players.FindAll()[2] != player {
+		t.Errorf("Reconnected player must keep the seat %s", names(game))
+	}
+
+	if game.Players.FindTarget(map[string]interface{}{"seat": float64(3)}) != player ||
+		game.Players.FindTarget(float64(player.Id())) != player ||
+		game.Players.FindTarget(map[string]interface{}{"seat": float64(7)}) != nil {
+		t.Errorf("Wrong target by seat")
+	}
+
+	game.Players.Remove(game.Players.FindOneBySeat(1))
+	if player.Seat() != 2 {
+		t.Errorf("Players after a free seat must move up %s", names(game))
+	}
+}
+
+func TestCleanupAbandonedGames(t *testing.T) {
+	started := func(connected bool) *Game {
+		game := NewGame()
+		game.Event = NewAcceptEvent(game.Iteration, EVENT_DAY, ACTION_START)
+		game.UpdatedAt = time.Now().Add(-time.Hour)
+
+		player := NewPlayer()
+		player.SetGame(game)
+		game.Players.Add(player)
+		if connected {
+			Clients.Add(player)
+			t.Cleanup(func() { Clients.Remove(player) })
+		}
+
+		AddGame(game)
+		t.Cleanup(func() { RemoveGame(game) })
+		return game
+	}
+
+	abandoned := started(false)
+	connected := started(true)
+
+	CleanupGames(time.Minute, time.Minute)
+
+	if _, ok := FindGame(abandoned.Id); ok || !abandoned.isStopped() {
+		t.Errorf("Started game without connected players must be removed")
+	}
+
+	if _, ok := FindGame(connected.Id); !ok {
+		t.Errorf("Started game with a connected player must be kept")
+	}
+}
+
+func TestEventTimeout(t *testing.T) {
+	timeouts := TimeoutsConfig{Accept: time.Second, Vote: 2 * time.Second, Choice: 3 * time.Second}
+
+	game := NewGame()
+	for event, timeout := range map[IEvent]time.Duration{
+		NewGameEvent():                             0,
+		NewGameOverEvent(1, ROLE_MAFIA):            0,
+		NewAcceptEvent(1, EVENT_DAY, ACTION_START): time.Second,
+		NewNightResultEvent(1):                     time.Second,
+		NewCourtResultEvent(1):                     time.Second,
+		NewSheriffResultEvent(1):                   time.Second,
+		NewMafiaEvent(1):                           2 * time.Second,
+		NewCourtEvent(1):                           2 * time.Second,
+		NewDoctorEvent(1):                          3 * time.Second,
+		NewGirlEvent(1):                            3 * time.Second,
+		NewSheriffEvent(1):                         3 * time.Second,
+	} {
+		game.Event = event
+		if game.eventTimeout(timeouts) != timeout {
+			t.Errorf("Timeout of %s must be %s, got %s", event.Name(), timeout, game.eventTimeout(timeouts))
+		}
+	}
+}
+
+func TestTimeoutEvent(t *testing.T) {
+	game := NewGame()
+	game.Iteration = 2
+	for _, role := range []int{ROLE_MAFIA, ROLE_MAFIA, ROLE_DOCTOR, ROLE_SHERIFF, ROLE_GIRL, ROLE_CITIZEN} {
+		player := NewPlayer()
+		player.SetGame(game)
+		player.SetRole(role)
+		game.Players.Add(player)
+	}
+	mafia := game.Players.FindByRole(ROLE_MAFIA)
+	citizen := game.Players.FindOneByRole(ROLE_CITIZEN)
+
+	// timeout processes the event, then times it out before every player answered
+	timeout := func(event IEvent, answer func()) {
+		game.Event = event
+		event.Process(game.Players, game.EventsHistory)
+		if answer != nil {
+			answer()
+		}
+		if event.Status() != IN_PROCESS {
+			t.Fatalf("Event %s must wait for players", event.Name())
+		}
+
+		game.timeoutEvent()
+		if event.Status() != PROCESSED {
+			t.Errorf("Timed out event %s must be processed", event.Name())
+		}
+		game.EventsHistory.Push(event)
+	}
+
+	accept := NewAcceptEvent(game.Iteration, EVENT_NIGHT, ACTION_START)
+	timeout(accept, func() { accept.AddAccepted(mafia[0]) })
+
+	mafiaEvent := NewMafiaEvent(game.Iteration)
+	timeout(mafiaEvent, func() { mafiaEvent.AddVoted(mafia[0], citizen) })
+	if mafiaEvent.Candidate() != citizen {
+		t.Errorf("Mafia must choose from the votes given before the timeout")
+	}
+
+	doctor := NewDoctorEvent(game.Iteration)
+	timeout(doctor, nil)
+	girl := NewGirlEvent(game.Iteration)
+	timeout(girl, nil)
+	sheriff := NewSheriffEvent(game.Iteration)
+	timeout(sheriff, nil)
+	if doctor.Choice() != nil || girl.Choice() != nil || sheriff.Choice() != nil {
+		t.Errorf("Timed out choice must be empty")
+	}
+
+	sheriffResult := NewSheriffResultEvent(game.Iteration)
+	if err := sheriffResult.Process(game.Players, game.EventsHistory); err == nil || sheriffResult.Status() != PROCESSED {
+		t.Errorf("Sheriff result without choice must be skipped, err: %v", err)
+	}
+
+	nightResult := NewNightResultEvent(game.Iteration)
+	timeout(nightResult, nil)
+	if nightResult.Killed() != citizen || !citizen.Out() {
+		t.Errorf("Night result must kill the candidate of the timed out mafia vote")
+	}
+
+	court := NewCourtEvent(game.Iteration)
+	timeout(court, func() { court.AddVoted(mafia[1], mafia[0]) })
+
+	courtResult := NewCourtResultEvent(game.Iteration)
+	timeout(courtResult, nil)
+	if courtResult.Convicted() != mafia[0] {
+		t.Errorf("Court must convict from the votes given before the timeout")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Version and Commit are set at build time with -ldflags "-X main.Version=... -X main.Commit=...".
+var Version = "v1.0.0"
+var Commit = "unknown"
+
+var startedAt = time.Now()
+
+// storeTimeout is how long readiness waits for the game registry.
+const storeTimeout = time.Second
+
+func health(w http.ResponseWriter, r *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+
+	games := FindGames()
+	lag := make(map[string]float64, len(games))
+	lags := make([]float64, 0, len(games))
+	for _, game := range games {
+		if game.isStopped() {
+			continue
+		}
+		ms := game.LoopLag().Seconds() * 1000
+		lag[strconv.Itoa(game.Id)] = ms
+		lags = append(lags, ms)
+	}
+	sort.Float64s(lags)
+
+	health := map[string]interface{}{
+		"runtime.NumGoroutine":        runtime.NumGoroutine(),
+		"runtime.MemStats.Alloc":      memStats.Alloc,
+		"runtime.MemStats.TotalAlloc": memStats.TotalAlloc,
+		"runtime.MemStats.Sys":        memStats.Sys,
+		"runtime.MemStats.NumGC":      memStats.NumGC,
+		"uptime":                      time.Since(startedAt).Round(time.Second).String(),
+		"version":                     Version,
+		"commit":                      Commit,
+		"games":                       len(lags),
+		"sockets":                     Clients.Len(),
+		"event_loop_lag_max_ms":       lagPercentile(lags, 100),
+		"event_loop_lag_p99_ms":       lagPercentile(lags, 99),
+	}
+
+	// ids of private games are only known to their players, the lag per game is for admins
+	if isAdmin(r) {
+		health["event_loop_lag_ms"] = lag
+	}
+
+	writeJSON(w, http.StatusOK, health)
+}
+
+// lagPercentile returns the p-th percentile of sorted lags, zero without games.
+func lagPercentile(lags []float64, p int) float64 {
+	if len(lags) == 0 {
+		return 0
+	}
+
+	return lags[(len(lags)*p-1)/100]
+}
+
+// livez answers while the process serves requests.
+func livez(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyz fails while shutting down or when the game registry does not respond.
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if IsShuttingDown() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+
+	if !GamesReachable(storeTimeout) {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "game store unreachable"})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	w := httptest.NewRecorder()
+	readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Readyz must be ok, got %d", w.Code)
+	}
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	w = httptest.NewRecorder()
+	readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Readyz must fail on shutdown, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	livez(w, httptest.NewRequest("GET", "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Livez must be ok on shutdown, got %d", w.Code)
+	}
+}
+
+func TestHealthHidesGameIds(t *testing.T) {
+	token := Conf.AdminToken
+	defer func() { Conf.AdminToken = token }()
+	Conf.AdminToken = "secret"
+
+	game := NewGame()
+	game.Settings.Visibility = VISIBILITY_PRIVATE
+	AddGame(game)
+	defer RemoveGame(game)
+
+	request := func(token string) map[string]interface{} {
+		req := httptest.NewRequest("GET", "/health", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		health(w, req)
+
+		body := map[string]interface{}{}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &body) != nil {
+			t.Fatalf("Wrong health response %d %s", w.Code, w.Body.String())
+		}
+		return body
+	}
+
+	body := request("")
+	if _, ok := body["event_loop_lag_ms"]; ok || body["event_loop_lag_max_ms"] == nil || body["games"].(float64) < 1 {
+		t.Errorf("Health without the admin token must report the aggregate lag only %v", body)
+	}
+
+	lag, _ := request("secret")["event_loop_lag_ms"].(map[string]interface{})
+	if _, ok := lag[strconv.Itoa(game.Id)]; !ok {
+		t.Errorf("Admin must get the lag per game %v", lag)
+	}
+}
+
+func TestLagPercentile(t *testing.T) {
+	lags := make([]float64, 0)
+	for i := 1; i <= 100; i++ {
+		lags = append(lags, float64(i))
+	}
+
+	if lagPercentile(nil, 99) != 0 || lagPercentile(lags, 99) != 99 || lagPercentile(lags, 100) != 100 || lagPercentile(lags[:1], 99) != 1 {
+		t.Errorf("Wrong lag percentiles")
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const JOURNAL_ACTION = "action"
+const JOURNAL_MESSAGE = "message"
+const JOURNAL_EVENT = "event"
+const JOURNAL_GAME = "game"
+
+const SCOPE_PUBLIC = "public"
+const SCOPE_PRIVATE = "private"
+
+// JournalEntry is one line of the game journal: the game settings, an action sent by a player,
+// a message sent by the server with the players who saw it, or the start of an event.
+// EventStatus of an action is the status of the game event when the action was applied.
+type JournalEntry struct {
+	Time        time.Time   `json:"time"`
+	Kind        string      `json:"kind"`
+	Event       string      `json:"event"`
+	Iteration   int         `json:"iteration"`
+	EventStatus int         `json:"event_status,omitempty"`
+	Action      string      `json:"action,omitempty"`
+	Status      string      `json:"status,omitempty"`
+	Player      int         `json:"player,omitempty"`
+	Scope       string      `json:"scope,omitempty"`
+	To          []int       `json:"to,omitempty"`
+	Data        interface{} `json:"data,omitempty"`
+	message     *Message
+}
+
+// JournalGame is the data of the game entry, the seed is a string since JSON numbers lose int64 precision.
+type JournalGame struct {
+	Id       int          `json:"id"`
+	Seed     int64        `json:"seed,string"`
+	Settings GameSettings `json:"settings"`
+}
+
+// Journal is the append-only record of a game, kept in memory and appended to
+// <journal_dir>/<created>-<id>.jsonl when journal_dir is set.
+type Journal struct {
+	mutex   sync.Mutex
+	game    *Game
+	entries []*JournalEntry
+	path    string
+	file    *os.File
+	writer  *bufio.Writer
+	failed  bool
+}
+
+func NewJournal(game *Game) *Journal {
+	journal := NewMemoryJournal(game)
+
+	if Conf.JournalDir != "" {
+		name := fmt.Sprintf("%s-%d.jsonl", game.CreatedAt.UTC().Format("20060102T150405.000"), game.Id)
+		journal.path = filepath.Join(Conf.JournalDir, name)
+	}
+
+	return journal
+}
+
+// NewMemoryJournal is a journal that is never written to disk.
+func NewMemoryJournal(game *Game) *Journal {
+	return &Journal{
+		game:    game,
+		entries: make([]*JournalEntry, 0),
+	}
+}
+
+// Game records the id, seed and settings the game is started with.
+func (j *Journal) Game() {
+	j.append(&JournalEntry{
+		Time:      time.Now(),
+		Kind:      JOURNAL_GAME,
+		Event:     j.game.Event.Name(),
+		Iteration: j.game.Iteration,
+		Data:      JournalGame{Id: j.game.Id, Seed: j.game.Seed, Settings: j.game.Settings},
+	})
+}
+
+// Action records a message received from player.
+func (j *Journal) Action(player *Player, msg *Message) {
+	j.append(&JournalEntry{
+		Time:        time.Now(),
+		Kind:        JOURNAL_ACTION,
+		Event:       msg.Event,
+		Iteration:   msg.Iteration,
+		EventStatus: j.game.Event.Status(),
+		Action:      msg.Action,
+		Player:      player.Id(),
+		Data:        msg.Data,
+	})
+}
+
+// Message records a message sent to player, a broadcast of the same message is one entry.
+func (j *Journal) Message(player *Player, msg *Message) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if len(j.entries) > 0 {
+		last := j.entries[len(j.entries)-1]
+		if last.message == msg {
+			last.To = append(last.To, player.Id())
+			last.Scope = j.scope(last.To)
+			return
+		}
+	}
+
+	j.appendLocked(&JournalEntry{
+		Time:      time.Now(),
+		Kind:      JOURNAL_MESSAGE,
+		Event:     msg.Event,
+		Iteration: msg.Iteration,
+		Action:    msg.Action,
+		Status:    msg.Status,
+		Scope:     SCOPE_PRIVATE,
+		To:        []int{player.Id()},
+		Data:      msg.Data,
+		message:   msg,
+	})
+}
+
+// Event records the start of event, buffered entries are written to the file on every event.
+func (j *Journal) Event(event IEvent, data interface{}) {
+	j.append(&JournalEntry{
+		Time:      time.Now(),
+		Kind:      JOURNAL_EVENT,
+		Event:     event.Name(),
+		Iteration: event.Iteration(),
+		Data:      data,
+	})
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.writer != nil {
+		if err := j.writer.Flush(); err != nil {
+			j.game.Log().Errorf("Journal write err: %v", err)
+		}
+	}
+}
+
+// scope is public when every player still in the game got the message,
+// broadcasts are not sent to players who are out.
+func (j *Journal) scope(to []int) string {
+	if len(to) < 2 {
+		return SCOPE_PRIVATE
+	}
+
+	received := make(map[int]bool, len(to))
+	for _, id := range to {
+		received[id] = true
+	}
+
+	for _, player := range j.game.Players.FindAll() {
+		if !received[player.Id()] {
+			return SCOPE_PRIVATE
+		}
+	}
+	return SCOPE_PUBLIC
+}
+
+func (j *Journal) append(entry *JournalEntry) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.appendLocked(entry)
+}
+
+// appendLocked is append for callers holding the mutex.
+func (j *Journal) appendLocked(entry *JournalEntry) {
+	if len(j.entries) > 0 {
+		j.flush(j.entries[len(j.entries)-1])
+	}
+	j.entries = append(j.entries, entry)
+}
+
+// flush writes entry to disk, entries are written once the next one starts
+// so broadcasts are written with every recipient.
+func (j *Journal) flush(entry *JournalEntry) {
+	if j.path == "" || j.failed {
+		return
+	}
+
+	if j.file == nil {
+		err := os.MkdirAll(filepath.Dir(j.path), 0755)
+		if err == nil {
+			j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		}
+		if err != nil {
+			j.failed = true
+			j.game.Log().Errorf("Journal open err: %v", err)
+			return
+		}
+		j.writer = bufio.NewWriter(j.file)
+	}
+
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = j.writer.Write(append(line, '\n'))
+	}
+	if err != nil {
+		j.game.Log().Errorf("Journal write err: %v", err)
+	}
+}
+
+// Close writes the pending entry and closes the file.
+func (j *Journal) Close() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if len(j.entries) > 0 {
+		j.flush(j.entries[len(j.entries)-1])
+	}
+
+	if j.file != nil {
+		if err := j.writer.Flush(); err != nil {
+			log.Errorf("Journal write err: %v", err)
+		}
+		if err := j.file.Close(); err != nil {
+			log.Errorf("Journal close err: %v", err)
+		}
+		j.file = nil
+		j.writer = nil
+	}
+	j.path = ""
+}
+
+// Entries returns the journal in chronological order.
+func (j *Journal) Entries() []*JournalEntry {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	entries := make([]*JournalEntry, len(j.entries))
+	for i, entry := range j.entries {
+		copied := *entry
+		copied.To = append([]int(nil), entry.To...)
+		entries[i] = &copied
+	}
+	return entries
+}
+
+// CleanupJournals removes journal files of dir not written for longer than retention.
+func CleanupJournals(dir string, retention time.Duration) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil {
+		log.Errorf("Journal cleanup err: %v", err)
+		return
+	}
+
+	for _, path := range paths {
+		stat, err := os.Stat(path)
+		if err != nil || time.Since(stat.ModTime()) <= retention {
+			continue
+		}
+
+		log.WithField("path", path).Info("Remove old journal")
+		if err := os.Remove(path); err != nil {
+			log.Errorf("Journal remove err: %v", err)
+		}
+	}
+}
+
+func JournalsGC(every time.Duration, dir string, retention time.Duration) {
+	if dir == "" || retention == 0 {
+		return
+	}
+
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		CleanupJournals(dir, retention)
+	}
+}
+
+// ReadJournal reads the latest journal file written for game id.
+func ReadJournal(id int) ([]*JournalEntry, error) {
+	if Conf.JournalDir == "" {
+		return nil, os.ErrNotExist
+	}
+
+	paths, err := filepath.Glob(filepath.Join(Conf.JournalDir, fmt.Sprintf("*-%d.jsonl", id)))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, os.ErrNotExist
+	}
+	sort.Strings(paths)
+
+	file, err := os.Open(paths[len(paths)-1])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := make([]*JournalEntry, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		entry := &JournalEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestJournal(t *testing.T) {
+	game := NewGame()
+
+	mafia := NewPlayer()
+	mafia.SetGame(game)
+	game.Players.Add(mafia)
+
+	citizen := NewPlayer()
+	citizen.SetGame(game)
+	game.Players.Add(citizen)
+
+	game.Journal.Action(mafia, &Message{Event: EVENT_GAME, Action: ACTION_START})
+
+	rmsg := NewEventMessage(game.Event, ACTION_START)
+	mafia.SendMessage(rmsg)
+	citizen.SendMessage(rmsg)
+
+	role := NewEventMessage(game.Event, ACTION_ROLE)
+	role.Data = ROLE_MAFIA
+	mafia.SendMessage(role)
+
+	entries := game.Journal.Entries()
+	if len(entries) != 3 {
+		t.Fatalf("Journal must have 3 entries, got %d", len(entries))
+	}
+
+	if entries[0].Kind != JOURNAL_ACTION || entries[0].Player != mafia.Id() {
+		t.Errorf("Wrong action entry %#v", entries[0])
+	}
+
+	if entries[1].Scope != SCOPE_PUBLIC || len(entries[1].To) != 2 {
+		t.Errorf("Broadcast must be one public entry %#v", entries[1])
+	}
+
+	if entries[2].Scope != SCOPE_PRIVATE || entries[2].To[0] != mafia.Id() {
+		t.Errorf("Role must be a private entry %#v", entries[2])
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/games/{id}/replay", apiReplayGame)
+	AddGame(game)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/games/"+strconv.Itoa(game.Id)+"/replay", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Replay of a running game must be refused, got %d", w.Code)
+	}
+
+	game.Stop()
+	RemoveGame(game)
+
+	stored, err := ReadJournal(game.Id)
+	if err != nil || len(stored) != 3 {
+		t.Errorf("Journal file must have 3 entries, err: %v", err)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/games/"+strconv.Itoa(game.Id)+"/replay", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Replay of a removed game must be read from disk, got %d", w.Code)
+	}
+}
+
+func TestJournalScopeWithOutPlayers(t *testing.T) {
+	game := NewGame()
+	for i := 0; i < 3; i++ {
+		player := NewPlayer()
+		player.SetGame(game)
+		game.Players.Add(player)
+	}
+	game.Players.FindAll()[2].SetOut(true)
+
+	rmsg := NewEventMessage(game.Event, ACTION_START)
+	for _, player := range game.Players.FindAll() {
+		player.SendMessage(rmsg)
+	}
+
+	private := NewEventMessage(game.Event, ACTION_ROLE)
+	game.Players.FindAll()[0].SendMessage(private)
+
+	entries := game.Journal.Entries()
+	if entries[0].Scope != SCOPE_PUBLIC {
+		t.Errorf("Broadcast to the players in the game must be public %#v", entries[0])
+	}
+	if entries[1].Scope != SCOPE_PRIVATE {
+		t.Errorf("Message to one player must be private %#v", entries[1])
+	}
+}
+
+func TestCleanupJournals(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "old-1.jsonl")
+	recent := filepath.Join(dir, "recent-2.jsonl")
+	for _, path := range []string{old, recent} {
+		if err := os.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+			t.Fatalf("Write journal err: %v", err)
+		}
+	}
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(old, past, past)
+
+	CleanupJournals(dir, time.Hour)
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Errorf("Old journal must be removed")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Errorf("Recent journal must be kept, err: %v", err)
+	}
+}
+
+func TestJournalConcurrentMessages(t *testing.T) {
+	game := NewGame()
+	game.Journal = NewMemoryJournal(game)
+	players := make([]*Player, 0)
+	for i := 0; i < 4; i++ {
+		player := NewPlayer()
+		game.Players.Add(player)
+		players = append(players, player)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rmsg := NewEventMessage(game.Event, ACTION_START)
+			for _, player := range players {
+				game.Journal.Message(player, rmsg)
+			}
+		}()
+	}
+	wg.Wait()
+
+	recipients := 0
+	for _, entry := range game.Journal.Entries() {
+		recipients += len(entry.To)
+	}
+	if recipients != 20*len(players) {
+		t.Errorf("Every message must be journaled once, got %d recipients", recipients)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+var Connections = NewConnectionLimiter()
+var GameCreations = NewWindowLimiter(time.Minute)
+var Logins = NewWindowLimiter(time.Minute)
+var Uploads = NewWindowLimiter(time.Minute)
+
+type LimitsConfig struct {
+	ConnectionsPerIP  int     `mapstructure:"connections_per_ip" yaml:"connections_per_ip"`
+	MessagesPerSecond float64 `mapstructure:"messages_per_second" yaml:"messages_per_second"`
+	MessageBurst      int     `mapstructure:"message_burst" yaml:"message_burst"`
+	MaxViolations     int     `mapstructure:"max_violations" yaml:"max_violations"`
+	GamesPerMinute    int     `mapstructure:"games_per_minute" yaml:"games_per_minute"`
+	OutboundQueue     int     `mapstructure:"outbound_queue" yaml:"outbound_queue"`
+	LoginsPerMinute   int     `mapstructure:"logins_per_minute" yaml:"logins_per_minute"`
+	UploadsPerMinute  int     `mapstructure:"uploads_per_minute" yaml:"uploads_per_minute"`
+}
+
+func DefaultLimitsConfig() LimitsConfig {
+	return LimitsConfig{
+		ConnectionsPerIP:  20,
+		MessagesPerSecond: 10,
+		MessageBurst:      20,
+		MaxViolations:     20,
+		GamesPerMinute:    5,
+		OutboundQueue:     64,
+		LoginsPerMinute:   10,
+		UploadsPerMinute:  5,
+	}
+}
+
+// RemoteIP strips the port from a remote address.
+func RemoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+/*
+ConnectionLimiter
+*/
+
+// ConnectionLimiter counts open connections per IP.
+type ConnectionLimiter struct {
+	mutex sync.Mutex
+	data  map[string]int
+}
+
+func NewConnectionLimiter() *ConnectionLimiter {
+	return &ConnectionLimiter{data: make(map[string]int, 0)}
+}
+
+// Acquire reserves a connection for ip, false if ip has reached connections_per_ip.
+func (l *ConnectionLimiter) Acquire(ip string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if Conf.Limits.ConnectionsPerIP != 0 && l.data[ip] >= Conf.Limits.ConnectionsPerIP {
+		return false
+	}
+
+	l.data[ip]++
+	return true
+}
+
+func (l *ConnectionLimiter) Release(ip string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.data[ip] <= 1 {
+		delete(l.data, ip)
+		return
+	}
+
+	l.data[ip]--
+}
+
+/*
+WindowLimiter
+*/
+
+// WindowLimiter allows a number of events per key in a sliding window.
+type WindowLimiter struct {
+	mutex  sync.Mutex
+	window time.Duration
+	data   map[string][]time.Time
+}
+
+func NewWindowLimiter(window time.Duration) *WindowLimiter {
+	return &WindowLimiter{
+		window: window,
+		data:   make(map[string][]time.Time, 0),
+	}
+}
+
+// Allow records an event for key unless limit events already happened in the window, zero limit allows everything.
+func (l *WindowLimiter) Allow(key string, limit int) bool {
+	if limit == 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	events := make([]time.Time, 0, limit)
+	for _, event := range l.data[key] {
+		if now.Sub(event) < l.window {
+			events = append(events, event)
+		}
+	}
+
+	if len(events) >= limit {
+		l.data[key] = events
+		return false
+	}
+
+	l.data[key] = append(events, now)
+	return true
+}
+
+// Cleanup forgets keys without events in the window.
+func (l *WindowLimiter) Cleanup() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	for key, events := range l.data {
+		if len(events) == 0 || now.Sub(events[len(events)-1]) >= l.window {
+			delete(l.data, key)
+		}
+	}
+}
+
+func LimitsGC(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		GameCreations.Cleanup()
+		Logins.Cleanup()
+		Uploads.Cleanup()
+	}
+}
+
+/*
+MessageLimiter
+*/
+
+// MessageLimiter limits messages of one connection.
+type MessageLimiter struct {
+	mutex      sync.Mutex
+	limiter    *rate.Limiter
+	violations int
+}
+
+func NewMessageLimiter() *MessageLimiter {
+	if Conf.Limits.MessagesPerSecond == 0 {
+		return nil
+	}
+
+	return &MessageLimiter{
+		limiter: rate.NewLimiter(rate.Limit(Conf.Limits.MessagesPerSecond), Conf.Limits.MessageBurst),
+	}
+}
+
+// Allow reports whether a message can be handled and whether the connection has to be closed
+// because of too many rejected messages.
+func (l *MessageLimiter) Allow() (allowed bool, disconnect bool) {
+	if l == nil {
+		return true, false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.limiter.Allow() {
+		l.violations = 0
+		return true, false
+	}
+
+	l.violations++
+	return false, Conf.Limits.MaxViolations != 0 && l.violations >= Conf.Limits.MaxViolations
+}
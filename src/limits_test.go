@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionLimiter(t *testing.T) {
+	limits := Conf.Limits
+	defer func() { Conf.Limits = limits }()
+	Conf.Limits.ConnectionsPerIP = 2
+
+	l := NewConnectionLimiter()
+	if !l.Acquire("10.0.0.1") || !l.Acquire("10.0.0.1") {
+		t.Fatalf("Connections up to the limit must be allowed")
+	}
+	if l.Acquire("10.0.0.1") {
+		t.Errorf("Connection over the limit must be refused")
+	}
+	if !l.Acquire("10.0.0.2") {
+		t.Errorf("Limit is per ip")
+	}
+
+	l.Release("10.0.0.1")
+	if !l.Acquire("10.0.0.1") {
+		t.Errorf("Released connection must be available again")
+	}
+
+	l.Release("10.0.0.2")
+	if _, ok := l.data["10.0.0.2"]; ok {
+		t.Errorf("Ip without connections must be forgotten")
+	}
+
+	Conf.Limits.ConnectionsPerIP = 0
+	if !l.Acquire("10.0.0.1") {
+		t.Errorf("Zero limit must allow every connection")
+	}
+}
+
+func TestWindowLimiter(t *testing.T) {
+	l := NewWindowLimiter(50 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if !l.Allow("10.0.0.1", 2) {
+			t.Fatalf("Games up to the limit must be allowed")
+		}
+	}
+	if l.Allow("10.0.0.1", 2) {
+		t.Errorf("Game over the limit must be refused")
+	}
+	if !l.Allow("10.0.0.2", 2) {
+		t.Errorf("Limit is per key")
+	}
+	if !l.Allow("10.0.0.1", 0) {
+		t.Errorf("Zero limit must allow everything")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !l.Allow("10.0.0.1", 2) {
+		t.Errorf("Games must be allowed again after the window")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	l.Cleanup()
+	if len(l.data) != 0 {
+		t.Errorf("Cleanup must forget keys without events in the window %v", l.data)
+	}
+}
+
+func TestMessageLimiter(t *testing.T) {
+	limits := Conf.Limits
+	defer func() { Conf.Limits = limits }()
+	Conf.Limits.MessagesPerSecond = 0.001
+	Conf.Limits.MessageBurst = 2
+	Conf.Limits.MaxViolations = 3
+
+	l := NewMessageLimiter()
+	for i := 0; i < 2; i++ {
+		if allowed, _ := l.Allow(); !allowed {
+			t.Fatalf("Messages of the burst must be allowed")
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		allowed, disconnect := l.Allow()
+		if allowed || disconnect != (i == 3) {
+			t.Errorf("Violation %d: allowed %v, disconnect %v", i, allowed, disconnect)
+		}
+	}
+
+	Conf.Limits.MessagesPerSecond = 0
+	if l := NewMessageLimiter(); l != nil {
+		t.Errorf("Zero rate must not limit messages")
+	} else if allowed, disconnect := l.Allow(); !allowed || disconnect {
+		t.Errorf("Nil limiter must allow every message")
+	}
+}
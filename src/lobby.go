@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+var Lobby = NewLobbySubscribers()
+
+type LobbyView struct {
+	Id          int          `json:"id"`
+	Host        string       `json:"host"`
+	Settings    GameSettings `json:"settings"`
+	PlayerCount int          `json:"player_count"`
+	Roles       []int        `json:"roles"`
+	CreatedAt   time.Time    `json:"created_at"`
+	Rating      int          `json:"rating"`
+	Players     []PlayerView `json:"players"`
+}
+
+func NewLobbyView(game *Game) LobbyView {
+	view := LobbyView{
+		Id:          game.Id,
+		Settings:    game.Settings,
+		PlayerCount: len(game.Players.FindAll()),
+		Roles:       game.Settings.Roles.Deal(len(game.Players.FindAll())),
+		CreatedAt:   game.CreatedAt,
+		Players:     make([]PlayerView, 0),
+	}
+
+	if master := game.Players.FindMaster(); master != nil {
+		view.Host = master.Name()
+	}
+
+	players := game.Players.FindAll()
+	for _, player := range players {
+		view.Players = append(view.Players, NewPlayerView(player))
+	}
+
+	if len(players) > 0 {
+		sum := 0
+		for _, player := range players {
+			ratings := Accounts.Ratings(player.Account())
+			sum += (ratings.Mafia + ratings.Town) / 2
+		}
+		view.Rating = sum / len(players)
+	}
+
+	return view
+}
+
+// FindLobbies returns public games waiting for players, oldest first.
+func FindLobbies() []LobbyView {
+	lobbies := make([]LobbyView, 0)
+	for _, game := range FindGames() {
+		if !game.isLobby() || game.Settings.Visibility != VISIBILITY_PUBLIC {
+			continue
+		}
+		lobbies = append(lobbies, NewLobbyView(game))
+	}
+
+	sort.Slice(lobbies, func(i, j int) bool {
+		return lobbies[i].CreatedAt.Before(lobbies[j].CreatedAt)
+	})
+
+	return lobbies
+}
+
+/*
+LobbySubscribers
+*/
+
+// LobbySubscribers are players browsing lobbies, they get the list again every time it changes.
+type LobbySubscribers struct {
+	mutex sync.Mutex
+	data  map[*Player]bool
+}
+
+func NewLobbySubscribers() *LobbySubscribers {
+	return &LobbySubscribers{data: make(map[*Player]bool, 0)}
+}
+
+func (l *LobbySubscribers) Subscribe(player *Player) {
+	l.mutex.Lock()
+	l.data[player] = true
+	l.mutex.Unlock()
+
+	player.SendMessage(NewLobbiesMessage(FindLobbies()))
+}
+
+func (l *LobbySubscribers) Unsubscribe(player *Player) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.data, player)
+}
+
+func (l *LobbySubscribers) FindAll() []*Player {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	players := make([]*Player, 0, len(l.data))
+	for player := range l.data {
+		players = append(players, player)
+	}
+	return players
+}
+
+// Broadcast sends the current lobby list to every subscriber.
+func (l *LobbySubscribers) Broadcast() {
+	players := l.FindAll()
+	if len(players) == 0 {
+		return
+	}
+
+	rmsg := NewLobbiesMessage(FindLobbies())
+	for _, player := range players {
+		player.SendMessage(rmsg)
+	}
+}
+
+func NewLobbiesMessage(lobbies []LobbyView) *Message {
+	return &Message{
+		Status: STATUS_OK,
+		Event:  EVENT_GAME,
+		Action: ACTION_LOBBIES,
+		Data:   lobbies,
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const LOG_REDACTED = "redacted"
+
+// LogFormatter writes `[time][level][version] message key=value ...`.
+type LogFormatter struct{}
+
+func (f *LogFormatter) Format(entry *log.Entry) ([]byte, error) {
+	t := entry.Time.Format("2006-01-02T15:04:05.999Z07:00")
+
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var fields strings.Builder
+	for _, key := range keys {
+		fmt.Fprintf(&fields, " %s=%v", key, entry.Data[key])
+	}
+
+	return []byte(fmt.Sprintf("[%s][%s][%s] %s%s\n", t, entry.Level.String(), Version, entry.Message, fields.String())), nil
+}
+
+func NewLogFormatter(format string) log.Formatter {
+	switch format {
+	case LOG_FORMAT_JSON:
+		return &log.JSONFormatter{}
+	case LOG_FORMAT_LOGFMT:
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true}
+	}
+	return &LogFormatter{}
+}
+
+// RedactHook hides roles on lines above debug level, so production logs do not spoil games.
+type RedactHook struct{}
+
+func (h *RedactHook) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel}
+}
+
+func (h *RedactHook) Fire(entry *log.Entry) error {
+	if _, ok := entry.Data["role"]; ok {
+		entry.Data["role"] = LOG_REDACTED
+	}
+	return nil
+}
+
+// Log returns a logger with the player and, once the player is in a game, the game fields.
+func (p *Player) Log() *log.Entry {
+	fields := log.Fields{
+		"player_id": p.Id(),
+		"role":      p.Role(),
+	}
+
+	if game := p.Game(); game != nil {
+		fields["game_id"] = game.Id
+		if game.Event != nil {
+			fields["event"] = game.Event.Name()
+			fields["iteration"] = game.Event.Iteration()
+		}
+	}
+
+	return log.WithFields(fields)
+}
+
+// Log returns a logger with the game id and the current event.
+func (game *Game) Log() *log.Entry {
+	fields := log.Fields{"game_id": game.Id}
+	if game.Event != nil {
+		fields["event"] = game.Event.Name()
+		fields["iteration"] = game.Event.Iteration()
+	}
+
+	return log.WithFields(fields)
+}
+
+// Log returns the logger of the game of players, events only know the players of their game.
+func (p *Players) Log() *log.Entry {
+	for _, player := range p.data {
+		if game := player.Game(); game != nil {
+			return game.Log()
+		}
+	}
+
+	return log.NewEntry(log.StandardLogger())
+}
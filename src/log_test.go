@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestLogRedactsRoles(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New()
+	logger.SetOutput(&out)
+	logger.SetFormatter(&log.JSONFormatter{})
+	logger.SetLevel(log.DebugLevel)
+	logger.AddHook(&RedactHook{})
+
+	logger.WithField("role", ROLE_MAFIA).Debug("debug")
+	if !strings.Contains(out.String(), `"role":2`) {
+		t.Errorf("Role must be logged on debug level: %s", out.String())
+	}
+
+	out.Reset()
+	logger.WithField("role", ROLE_MAFIA).Info("info")
+	if !strings.Contains(out.String(), `"role":"redacted"`) {
+		t.Errorf("Role must be redacted on info level: %s", out.String())
+	}
+}
+
+func TestPlayersLog(t *testing.T) {
+	game := NewGame()
+	game.Event = NewNightResultEvent(1)
+	player := NewPlayer()
+	player.SetGame(game)
+	game.Players.Add(player)
+
+	entry := game.Players.Log()
+	if entry.Data["game_id"] != game.Id || entry.Data["event"] != EVENT_NIGHT_RESULT || entry.Data["iteration"] != 1 {
+		t.Errorf("Players must log with the fields of their game %v", entry.Data)
+	}
+
+	if entry := NewPlayers().Log(); len(entry.Data) != 0 {
+		t.Errorf("Players without a game must log without fields %v", entry.Data)
+	}
+}
@@ -2,67 +2,135 @@ package main
 
 import (
 	"encoding/json"
-	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"runtime"
 	"runtime/debug"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 )
 
-type LogFormatter struct{}
-
-func (f *LogFormatter) Format(entry *log.Entry) ([]byte, error) {
-	t := entry.Time.Format("2006-01-02T15:04:05.999Z07:00")
-	return []byte(fmt.Sprintf("[%s][%s][v1.0.0] %s\n", t, entry.Level.String(), entry.Message)), nil
-}
-
-var port = flag.Int("port", 4000, "port")
-
 func init() {
-	flag.Parse()
-
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	log.SetFormatter(&LogFormatter{})
 	log.SetOutput(os.Stdout)
-	log.SetLevel(log.Level(5))
+	log.SetLevel(log.DebugLevel)
+	log.AddHook(&RedactHook{})
+}
+
+func setupLog(config LogConfig) {
+	level, _ := log.ParseLevel(config.Level)
+	log.SetLevel(level)
+	log.SetFormatter(NewLogFormatter(config.Format))
 }
 
 func main() {
+	config, printConfig, err := LoadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Config error %v\n", err)
+		os.Exit(2)
+	}
+
+	if printConfig {
+		err = config.Print(os.Stdout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Config error %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	Conf = config
+	setupLog(Conf.Log)
+
+	Accounts, err = LoadAccounts(Conf.AccountsFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Accounts error %v\n", err)
+		os.Exit(1)
+	}
+
+	Avatars = NewAvatarStore(Conf.AvatarDir)
+
 	r := mux.NewRouter()
 	r.HandleFunc("/health", health)
+	r.HandleFunc("/livez", livez)
+	r.HandleFunc("/readyz", readyz)
 	r.HandleFunc("/info", info)
+	r.Handle("/metrics", promhttp.Handler())
+	r.HandleFunc("/games", apiCreateGame).Methods("POST")
+	r.HandleFunc("/games", apiListGames).Methods("GET")
+	r.HandleFunc("/games/{id}", apiGetGame).Methods("GET")
+	r.HandleFunc("/games/{id}", apiDeleteGame).Methods("DELETE")
+	r.HandleFunc("/games/{id}/replay", apiReplayGame).Methods("GET")
+	r.HandleFunc("/games/{id}/summary", apiGameSummary).Methods("GET")
+	r.HandleFunc("/accounts", apiRegister).Methods("POST")
+	r.HandleFunc("/accounts/login", apiLogin).Methods("POST")
+	r.HandleFunc("/accounts/logout", apiLogout).Methods("POST")
+	r.HandleFunc("/leaderboard", apiLeaderboard).Methods("GET")
+	r.HandleFunc("/avatars", apiListAvatars).Methods("GET")
+	r.HandleFunc("/avatars", apiUploadAvatar).Methods("POST")
+	r.HandleFunc("/avatars/{id}", apiGetAvatar).Methods("GET")
+	r.HandleFunc("/sse", sseConnect).Methods("POST")
+	r.HandleFunc("/sse/{session}", sseStream).Methods("GET")
+	r.HandleFunc("/sse/{session}", sseAction).Methods("POST")
 	r.HandleFunc("/", ws)
 	http.Handle("/", r)
-	log.Debugf("Listen http://0.0.0.0:%d", *port)
-	err := http.ListenAndServe(fmt.Sprintf("0.0.0.0:%d", *port), nil)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Serve error %v\n", err)
-	}
-}
+	go SSEGC(sseSessionTTL)
+	go LimitsGC(time.Minute)
+	go GamesGC(time.Minute, Conf.LobbyTTL, Conf.GameRetention)
+	go JournalsGC(time.Hour, Conf.JournalDir, Conf.JournalRetention)
 
-func health(w http.ResponseWriter, r *http.Request) {
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
-	health := map[string]interface{}{
-		"runtime.NumGoroutine":        runtime.NumGoroutine(),
-		"runtime.MemStats.Alloc":      memStats.Alloc,
-		"runtime.MemStats.TotalAlloc": memStats.TotalAlloc,
-		"runtime.MemStats.Sys":        memStats.Sys,
-		"runtime.MemStats.NumGC":      memStats.NumGC,
-	}
+	server := &http.Server{Addr: Conf.Listen}
 
-	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(health)
+	stopped := make(chan struct{})
+	go func() {
+		sig := WaitForSignal()
+		log.Infof("Got %v", sig)
+		Shutdown(server, Conf.ShutdownTimeout)
+		close(stopped)
+	}()
+
+	if Conf.TLS.Cert != "" {
+		reloader := NewCertReloader(Conf.TLS.Cert, Conf.TLS.Key)
+		err = reloader.Reload()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "TLS error %v\n", err)
+			os.Exit(1)
+		}
+		go reloader.Watch(Conf.TLS.ReloadInterval)
+
+		if Conf.TLS.RedirectListen != "" {
+			go func() {
+				log.Debugf("Listen http://%s, redirect to https", Conf.TLS.RedirectListen)
+				err := NewRedirectServer(Conf.TLS.RedirectListen, Conf.Listen).ListenAndServe()
+				if err != nil {
+					log.Errorf("Redirect serve error %v", err)
+				}
+			}()
+		}
+
+		server.TLSConfig = NewTLSConfig(reloader)
+		log.Debugf("Listen https://%s", Conf.Listen)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Debugf("Listen http://%s", Conf.Listen)
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		<-stopped
+		return
+	}
 	if err != nil {
-		log.Errorf("Health error: %v", err)
+		fmt.Fprintf(os.Stderr, "Serve error %v\n", err)
+		os.Exit(1)
 	}
 }
 
@@ -81,12 +149,28 @@ func info(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	game, ok := Games[gameId]
+	game, ok := FindGame(gameId)
 	if !ok {
 		http.Error(w, "invalid game id", http.StatusBadRequest)
 		return
 	}
 
+	var info map[string]interface{}
+	if isAdmin(r) {
+		info = fullInfo(game)
+	} else {
+		info = publicInfo(game)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(info)
+	if err != nil {
+		log.Errorf("Info controller error: %v", err)
+	}
+}
+
+// fullInfo exposes roles and addresses of every player, it is only served to admins.
+func fullInfo(game *Game) map[string]interface{} {
 	playersInfo := make([]interface{}, 0)
 	for _, player := range game.Players.FindAll() {
 		playersInfo = append(playersInfo, map[string]interface{}{
@@ -98,7 +182,7 @@ func info(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 
-	info := map[string]interface{}{
+	return map[string]interface{}{
 		"id":           game.Id,
 		"event":        game.Event.Name(),
 		"event_status": game.Event.Status(),
@@ -107,12 +191,45 @@ func info(w http.ResponseWriter, r *http.Request) {
 		"is_over":      game.isOver(),
 		"players":      playersInfo,
 	}
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	err = json.NewEncoder(w).Encode(info)
-	if err != nil {
-		log.Errorf("Info controller error: %v", err)
+// publicInfo is safe to show to players: roles are revealed only after the game is over.
+func publicInfo(game *Game) map[string]interface{} {
+	isOver := game.isOver()
+
+	alive := make([]string, 0)
+	out := make([]string, 0)
+	roles := make([]interface{}, 0)
+	for _, player := range game.Players.FindAllWithOut() {
+		if player.Out() {
+			out = append(out, player.Name())
+		} else {
+			alive = append(alive, player.Name())
+		}
+
+		if isOver {
+			roles = append(roles, map[string]interface{}{
+				"name": player.Name(),
+				"role": player.Role(),
+			})
+		}
+	}
+
+	info := map[string]interface{}{
+		"id":      game.Id,
+		"event":   game.Event.Name(),
+		"iter":    game.Iteration,
+		"is_over": isOver,
+		"alive":   alive,
+		"out":     out,
+	}
+
+	if isOver {
+		info["win"] = game.Winner
+		info["roles"] = roles
 	}
+
+	return info
 }
 
 func ws(w http.ResponseWriter, r *http.Request) {
@@ -121,23 +238,49 @@ func ws(w http.ResponseWriter, r *http.Request) {
 	}()
 	log.Debugf("Server WS")
 
+	ip := RemoteIP(r.RemoteAddr)
+	if !Connections.Acquire(ip) {
+		log.Infof("Too many connections from %s", ip)
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
 	var upgrader = websocket.Upgrader{
 		ReadBufferSize:  4096,
 		WriteBufferSize: 4096,
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+		Subprotocols:    CodecNames(),
+		CheckOrigin:     checkOrigin,
 	}
 
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Debugf("Upgrade error %s: %v", r.URL.String(), err)
+		Connections.Release(ip)
 		return
 	}
 
 	player := NewPlayer()
-	player.SetConnection(conn)
 	player.SetAddr(r.RemoteAddr)
+	player.SetConnectionIp(ip)
+	player.SetCodec(FindCodec(conn.Subprotocol()))
+	player.SetTransport(NewWebsocketTransport(conn))
+}
+
+// checkOrigin allows requests without an Origin header and origins listed in allowed_origins,
+// any origin is allowed when the list is empty.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(Conf.AllowedOrigins) == 0 {
+		return true
+	}
+
+	for _, allowed := range Conf.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func GC(every time.Duration) {
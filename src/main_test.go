@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "mafia-journal")
+	if err != nil {
+		panic(err)
+	}
+	Conf.JournalDir = dir
+	Conf.AccountsFile = ""
+	// every test player has the same empty address, tests of the limits set their own
+	Conf.Limits.GamesPerMinute = 0
+	Conf.Limits.LoginsPerMinute = 0
+	Conf.Limits.UploadsPerMinute = 0
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestInfo(t *testing.T) {
+	token := Conf.AdminToken
+	defer func() { Conf.AdminToken = token }()
+	Conf.AdminToken = "secret"
+
+	game := NewGame()
+	AddGame(game)
+	defer RemoveGame(game)
+
+	for _, role := range []int{ROLE_MAFIA, ROLE_CITIZEN, ROLE_CITIZEN} {
+		player := NewPlayer()
+		player.SetAddr("10.0.0.1:1234")
+		player.SetGame(game)
+		player.SetRole(role)
+		game.Players.Add(player)
+	}
+	game.Event = NewCourtEvent(game.Iteration)
+
+	request := func(token string) map[string]interface{} {
+		req := httptest.NewRequest("GET", "/info?game="+strconv.Itoa(game.Id), nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		info(w, req)
+
+		body := map[string]interface{}{}
+		if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &body) != nil {
+			t.Fatalf("Wrong info response %d %s", w.Code, w.Body.String())
+		}
+		return body
+	}
+
+	has := func(body map[string]interface{}, key string) bool {
+		data, _ := json.Marshal(body)
+		return strings.Contains(string(data), `"`+key+`"`)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		if body := request(token); has(body, "role") || has(body, "roles") || has(body, "addr") || body["is_over"] != false {
+			t.Errorf("Info of a running game must hide roles and addresses %v", body)
+		}
+	}
+
+	game.Players.FindOneByRole(ROLE_MAFIA).SetOut(true)
+
+	body := request("")
+	roles, _ := body["roles"].([]interface{})
+	if body["is_over"] != true || len(roles) != 3 || has(body, "addr") {
+		t.Errorf("Info of a finished game must show roles only %v", body)
+	}
+
+	body = request("secret")
+	players, _ := body["players"].([]interface{})
+	if len(players) != 2 {
+		t.Fatalf("Admin must get every player in the game %v", body)
+	}
+	for _, player := range players {
+		player := player.(map[string]interface{})
+		if player["role"] == nil || player["addr"] != "10.0.0.1:1234" {
+			t.Errorf("Admin must get roles and addresses %v", player)
+		}
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	origins := Conf.AllowedOrigins
+	defer func() { Conf.AllowedOrigins = origins }()
+
+	request := func(origin string) *http.Request {
+		req := httptest.NewRequest("GET", "/ws", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		return req
+	}
+
+	Conf.AllowedOrigins = []string{}
+	if !checkOrigin(request("https://evil.example")) {
+		t.Errorf("Empty list must allow any origin")
+	}
+
+	Conf.AllowedOrigins = []string{"https://mafia.example"}
+	if !checkOrigin(request("https://MAFIA.example")) {
+		t.Errorf("Listed origin must be allowed")
+	}
+	if checkOrigin(request("https://evil.example")) {
+		t.Errorf("Unlisted origin must be rejected")
+	}
+	if !checkOrigin(request("")) {
+		t.Errorf("Request without origin must be allowed")
+	}
+
+	Conf.AllowedOrigins = []string{"*"}
+	if !checkOrigin(request("https://evil.example")) {
+		t.Errorf("Wildcard must allow any origin")
+	}
+}
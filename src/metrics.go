@@ -0,0 +1,128 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const ERROR_SHUTTING_DOWN = "shutting_down"
+const ERROR_TOO_MANY_GAMES = "too_many_games"
+const ERROR_RATE_LIMITED = "rate_limited"
+const ERROR_INVALID_GAME = "invalid_game"
+const ERROR_GAME_STOPPED = "game_stopped"
+const ERROR_UNDEFINED_ACTION = "undefined_action"
+const ERROR_ACTION = "action"
+const ERROR_ACCOUNT = "account"
+
+var (
+	GamesCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mafia_games_created_total",
+		Help: "Games created.",
+	})
+	GamesFinished = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "mafia_games_finished_total",
+		Help: "Games played until game over.",
+	})
+	GameWinners = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mafia_game_winners_total",
+		Help: "Finished games by winner team.",
+	}, []string{"team"})
+	PhaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "mafia_phase_duration_seconds",
+		Help:    "Time from the start of a phase until it is processed.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600, 1800},
+	}, []string{"phase"})
+	ActionErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mafia_action_errors_total",
+		Help: "Player messages answered with an error, by action and error type.",
+	}, []string{"action", "type"})
+	OutboundDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mafia_outbound_dropped_total",
+		Help: "Messages dropped from client queues: coalesced by a newer state, queue overflow or closed.",
+	}, []string{"reason"})
+	Connects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mafia_connects_total",
+		Help: "Client connections by transport.",
+	}, []string{"transport"})
+	Disconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "mafia_disconnects_total",
+		Help: "Client disconnections by transport.",
+	}, []string{"transport"})
+	ConnectedPlayers = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mafia_connected_players",
+		Help: "Clients with an open transport.",
+	}, func() float64 {
+		return float64(Clients.Len())
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		GamesCreated,
+		GamesFinished,
+		GameWinners,
+		PhaseDuration,
+		ActionErrors,
+		OutboundDrops,
+		Connects,
+		Disconnects,
+		ConnectedPlayers,
+		&gamesCollector{},
+	)
+}
+
+// gamesCollector reports running games by phase at scrape time.
+type gamesCollector struct{}
+
+var gamesDesc = prometheus.NewDesc("mafia_games", "Games that are not stopped, by phase.", []string{"phase"}, nil)
+
+func (c *gamesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- gamesDesc
+}
+
+func (c *gamesCollector) Collect(ch chan<- prometheus.Metric) {
+	phases := make(map[string]int, 0)
+	for _, game := range FindGames() {
+		if game.isStopped() {
+			continue
+		}
+		phases[game.Event.Name()]++
+	}
+
+	for phase, count := range phases {
+		ch <- prometheus.MustNewConstMetric(gamesDesc, prometheus.GaugeValue, float64(count), phase)
+	}
+}
+
+var metricActions = map[string]bool{
+	ACTION_CREATE:     true,
+	ACTION_RECONNECT:  true,
+	ACTION_JOIN:       true,
+	ACTION_START:      true,
+	ACTION_END:        true,
+	ACTION_ACCEPT:     true,
+	ACTION_VOTE:       true,
+	ACTION_CHOICE:     true,
+	ACTION_LOBBIES:    true,
+	ACTION_LEAVE:      true,
+	ACTION_PROFILE:    true,
+	ACTION_REMATCH:    true,
+	ACTION_APPEARANCE: true,
+}
+
+// CountActionError counts an error answer, unknown actions share one label so clients can not grow the series.
+func CountActionError(action string, kind string) {
+	if !metricActions[action] {
+		action = "other"
+	}
+	ActionErrors.WithLabelValues(action, kind).Inc()
+}
+
+func WinnerTeam(winner int) string {
+	switch winner {
+	case ROLE_MAFIA:
+		return "mafia"
+	case ROLE_CITIZEN:
+		return "citizen"
+	}
+	return "none"
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func TestMetrics(t *testing.T) {
+	CountActionError("vote", ERROR_ACTION)
+	CountActionError("<script>", ERROR_UNDEFINED_ACTION)
+
+	w := httptest.NewRecorder()
+	promhttp.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+
+	for _, line := range []string{
+		`mafia_action_errors_total{action="vote",type="action"}`,
+		`mafia_action_errors_total{action="other",type="undefined_action"}`,
+		`mafia_connected_players`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("Metrics have no %s", line)
+		}
+	}
+
+	if strings.Contains(body, "<script>") {
+		t.Errorf("Unknown action must not become a label")
+	}
+}
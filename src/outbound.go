@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrQueueClosed = errors.New("outbound queue is closed")
+var ErrQueueOverflow = errors.New("outbound queue overflow")
+
+// coalescedActions carry a full state, a queued one is dropped when a newer one of the same event
+// and iteration is sent. Players lists of different events differ (mafia teammates, night targets).
+var coalescedActions = map[string]bool{
+	ACTION_PLAYERS:         true,
+	ACTION_LOBBIES:         true,
+	ACTION_SERVER_SHUTDOWN: true,
+}
+
+// Outbound is an encoded message waiting for the transport.
+type Outbound struct {
+	Message *Message
+	Data    []byte
+}
+
+func (o *Outbound) coalesces(other *Outbound) bool {
+	return o.Message.Status != STATUS_ERR &&
+		other.Message.Status != STATUS_ERR &&
+		o.Message.Event == other.Message.Event &&
+		o.Message.Iteration == other.Message.Iteration &&
+		o.Message.Action == other.Message.Action &&
+		coalescedActions[o.Message.Action]
+}
+
+// OutboundQueue is a bounded per player queue, Push never blocks the game.
+type OutboundQueue struct {
+	mutex    sync.Mutex
+	items    []*Outbound
+	limit    int
+	ready    chan struct{}
+	closed   bool
+	overflow bool
+}
+
+func NewOutboundQueue(limit int) *OutboundQueue {
+	return &OutboundQueue{
+		items: make([]*Outbound, 0),
+		limit: limit,
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// Push queues item, a queued state message of the same event, iteration and action is replaced.
+// The queue is closed when it is full, the client has to reconnect.
+func (q *OutboundQueue) Push(item *Outbound) (coalesced bool, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return false, ErrQueueClosed
+	}
+
+	for i, queued := range q.items {
+		if queued.coalesces(item) {
+			q.items = append(q.items[:i], q.items[i+1:]...)
+			coalesced = true
+			break
+		}
+	}
+
+	if len(q.items) >= q.limit {
+		q.items = nil
+		q.closed = true
+		q.overflow = true
+		q.signal()
+		return coalesced, ErrQueueOverflow
+	}
+
+	q.items = append(q.items, item)
+	q.signal()
+	return coalesced, nil
+}
+
+func (q *OutboundQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop returns the oldest item without waiting.
+func (q *OutboundQueue) Pop() (*Outbound, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return item, true
+}
+
+// Ready is signalled after Push and Close.
+func (q *OutboundQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Wait blocks until an item is queued, false when the queue is closed and empty.
+func (q *OutboundQueue) Wait() (*Outbound, bool) {
+	for {
+		if item, ok := q.Pop(); ok {
+			return item, true
+		}
+
+		if q.Closed() {
+			return nil, false
+		}
+
+		<-q.ready
+	}
+}
+
+// Close stops accepting items, queued items can still be taken.
+func (q *OutboundQueue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+
+	q.closed = true
+	q.signal()
+}
+
+func (q *OutboundQueue) Closed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.closed
+}
+
+// Overflowed reports whether the queue was closed because the client did not keep up.
+func (q *OutboundQueue) Overflowed() bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.overflow
+}
+
+func (q *OutboundQueue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestOutboundQueueCoalesce(t *testing.T) {
+	queue := NewOutboundQueue(10)
+	queue.Push(&Outbound{Message: &Message{Action: ACTION_PLAYERS}, Data: []byte("1")})
+	queue.Push(&Outbound{Message: &Message{Action: ACTION_ACCEPT}, Data: []byte("2")})
+	coalesced, err := queue.Push(&Outbound{Message: &Message{Action: ACTION_PLAYERS}, Data: []byte("3")})
+
+	if !coalesced || err != nil {
+		t.Errorf("Players message must replace the queued one, coalesced: %v, err: %v", coalesced, err)
+	}
+
+	for _, data := range []string{"2", "3"} {
+		item, ok := queue.Pop()
+		if !ok || string(item.Data) != data {
+			t.Errorf("Wrong queued message, must be %s", data)
+		}
+	}
+
+	queue.Push(&Outbound{Message: &Message{Event: EVENT_GREET_MAFIA, Action: ACTION_PLAYERS}, Data: []byte("4")})
+	coalesced, _ = queue.Push(&Outbound{Message: &Message{Event: EVENT_MAFIA, Action: ACTION_PLAYERS}, Data: []byte("5")})
+	if coalesced || queue.Len() != 2 {
+		t.Errorf("Players messages of different events must both be sent")
+	}
+}
+
+func TestOutboundQueueOverflow(t *testing.T) {
+	queue := NewOutboundQueue(2)
+	for i := 0; i < 2; i++ {
+		if _, err := queue.Push(&Outbound{Message: &Message{Action: ACTION_ACCEPT}}); err != nil {
+			t.Errorf("Push err: %v", err)
+		}
+	}
+
+	if _, err := queue.Push(&Outbound{Message: &Message{Action: ACTION_ACCEPT}}); err != ErrQueueOverflow {
+		t.Errorf("Full queue must overflow, err: %v", err)
+	}
+
+	if _, ok := queue.Wait(); ok || !queue.Overflowed() {
+		t.Errorf("Overflowed queue must be closed and empty")
+	}
+
+	if _, err := queue.Push(&Outbound{Message: &Message{Action: ACTION_ACCEPT}}); err != ErrQueueClosed {
+		t.Errorf("Closed queue must reject messages, err: %v", err)
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"github.com/gorilla/websocket"
-	log "github.com/sirupsen/logrus"
-	"encoding/json"
 	"time"
 	"crypto/rand"
 	"fmt"
 	"encoding/binary"
+	mathrand "math/rand"
+
+	log "github.com/sirupsen/logrus"
 )
 
 const maxMessageSize = 4096 // Maximum message size allowed from peer.
@@ -22,11 +22,11 @@ const STATUS_OK = "ok"
 const STATUS_ERR = "err"
 
 type Message struct {
-	Status    string      `json:"status"`
-	Iteration int         `json:"iteration"`
-	Event     string      `json:"event"`
-	Action    string      `json:"action"`
-	Data      interface{} `json:"data"`
+	Status    string      `json:"status" msgpack:"status"`
+	Iteration int         `json:"iteration" msgpack:"iteration"`
+	Event     string      `json:"event" msgpack:"event"`
+	Action    string      `json:"action" msgpack:"action"`
+	Data      interface{} `json:"data" msgpack:"data"`
 }
 
 func NewEventMessage(event IEvent, action string) *Message {
@@ -45,10 +45,19 @@ type Player struct {
 	game               *Game
 	master             bool
 	addr               string
+	connectionIp       string
 	createdAt          time.Time
-	conn               *websocket.Conn
+	transport          Transport
+	codec              Codec
+	limiter            *MessageLimiter
 	out                bool
-	send               chan []byte
+	seat               int
+	avatar             string
+	color              string
+	status             string
+	account            *Account
+	send               *OutboundQueue
+	discard            bool
 	lastSendMessage    *Message
 	lastReceiveMessage *Message
 }
@@ -61,7 +70,7 @@ func GenerateRandomInt(n int) (int) {
 		return 0
 	}
 
-	return int(binary.BigEndian.Uint16(b))
+	return int(binary.BigEndian.Uint32(b) >> 1)
 }
 
 func NewPlayer() *Player {
@@ -69,7 +78,9 @@ func NewPlayer() *Player {
 	player := &Player{
 		id:   GenerateRandomInt(10),
 		createdAt: time.Now(),
-		send:      make(chan []byte, 5),
+		send:      NewOutboundQueue(Conf.Limits.OutboundQueue),
+		codec:     FindCodec(CODEC_JSON),
+		limiter:   NewMessageLimiter(),
 		out:       false,
 	}
 
@@ -79,24 +90,45 @@ func NewPlayer() *Player {
 func (p *Player) SendMessage(message *Message) {
 	defer func() {
 		if err := recover(); err != nil {
-			log.Errorf("Send message id: %d, err: %v", p.Id(), err)
+			p.Log().WithField("action", message.Action).Errorf("Send message err: %v", err)
 		}
 	}()
 
 	if
 		message.Status != STATUS_ERR &&
-		message.Action != ACTION_VOTE {
+		message.Action != ACTION_VOTE &&
+		message.Action != ACTION_SERVER_SHUTDOWN {
 		p.lastSendMessage = message
 	}
 
-	msg, err := json.Marshal(message)
+	msg, err := p.codec.Marshal(message)
 
 	if err != nil {
-		log.Errorf("Marshal message: id: %d, err: %v", p.Id(), err)
+		p.Log().WithField("action", message.Action).Errorf("Marshal message err: %v", err)
+		return
+	}
+
+	if game := p.Game(); game != nil {
+		game.Journal.Message(p, message)
+	}
+
+	// rebuilt players have no client, their messages only go to the journal
+	if p.discard {
 		return
 	}
 
-	p.send <- msg
+	coalesced, err := p.send.Push(&Outbound{Message: message, Data: msg})
+	if coalesced {
+		OutboundDrops.WithLabelValues("coalesced").Inc()
+	}
+
+	switch err {
+	case ErrQueueOverflow:
+		OutboundDrops.WithLabelValues("overflow").Inc()
+		p.Log().WithField("action", message.Action).Warn("Outbound queue overflow, disconnect client")
+	case ErrQueueClosed:
+		OutboundDrops.WithLabelValues("closed").Inc()
+	}
 }
 
 func (p *Player) SetGame(game *Game) {
@@ -115,6 +147,11 @@ func (p *Player) Addr() string {
 	return p.addr
 }
 
+// SetConnectionIp records the ip the connection was acquired for, Disconnect releases it.
+func (p *Player) SetConnectionIp(ip string) {
+	p.connectionIp = ip
+}
+
 func (p *Player) Id() int {
 	return p.id
 }
@@ -143,6 +180,14 @@ func (p *Player) Master() bool {
 	return p.master
 }
 
+func (p *Player) SetCodec(codec Codec) {
+	p.codec = codec
+}
+
+func (p *Player) Codec() Codec {
+	return p.codec
+}
+
 func (p *Player) SetOut(out bool) {
 	p.out = out
 }
@@ -151,47 +196,46 @@ func (p *Player) Out() bool {
 	return p.out
 }
 
-func (player *Player) SetConnection(conn *websocket.Conn) {
-	player.conn = conn
-	go player.readLoop()
-	go player.writeLoop()
+func (p *Player) SetSeat(seat int) {
+	p.seat = seat
 }
 
-func (p *Player) readLoop() {
-	log.Debugf("readLoop %d", p.Id())
-	defer func() {
-
-		if err := recover(); err != nil {
-			log.Errorf("Close readLoop id=%d err=%v", p.Id(), err)
-		}
+// Seat is the seat number of the player from 1, it is kept for the whole game and across reconnects.
+func (p *Player) Seat() int {
+	return p.seat
+}
 
-		log.Debugf("Closing on read end: %d", p.Id())
-		p.conn.Close()
+// Avatar is a predefined avatar or "upload:<id>" of an uploaded image, empty if not set.
+func (p *Player) Avatar() string {
+	return p.avatar
+}
 
-	}()
+func (p *Player) Color() string {
+	return p.color
+}
 
-	p.conn.SetReadLimit(maxMessageSize)
+func (p *Player) Status() string {
+	return p.status
+}
 
-	for {
-		_, message, err := p.conn.ReadMessage()
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
-				log.Infof("error: %v", err)
-			}
-			break
-		}
+func (p *Player) SetAccount(account *Account) {
+	p.account = account
+}
 
-		msg := &Message{}
-		err = json.Unmarshal(message, msg)
-		if err != nil {
-			log.Errorf("error on msg decode {msg:%s, err:%v, id:%d", string(message), err, p.Id())
-			break
-		}
+// Account is the account the player logged in with, nil for guests.
+func (p *Player) Account() *Account {
+	return p.account
+}
 
-		log.Debugf("rcv msg %d %#v", p.Id(), msg)
+func (p *Player) SetTransport(transport Transport) {
+	p.transport = transport
+	Clients.Add(p)
+	Connects.WithLabelValues(transport.Name()).Inc()
+	transport.Run(p)
+}
 
-		p.OnMessage(msg)
-	}
+func (p *Player) Transport() Transport {
+	return p.transport
 }
 
 func (p *Player) onReconnect(msg *Message) {
@@ -199,7 +243,7 @@ func (p *Player) onReconnect(msg *Message) {
 	gameId := int(data["game"].(float64))
 	playerId := int(data["player"].(float64))
 
-	game, ok := Games[gameId]
+	game, ok := FindGame(gameId)
 
 	if !ok {
 		rmsg := &Message{
@@ -208,11 +252,14 @@ func (p *Player) onReconnect(msg *Message) {
 			Status: STATUS_ERR,
 			Data:   "invalid gameId",
 		}
-		log.Errorf("Invalid game id %v", gameId)
+		p.Log().WithField("action", msg.Action).Errorf("Invalid game id %v", gameId)
 		p.SendMessage(rmsg)
 		return
 	}
 
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+
 	if game.isOver() {
 		rmsg := &Message{
 			Event: EVENT_GAME,
@@ -220,7 +267,7 @@ func (p *Player) onReconnect(msg *Message) {
 			Status: STATUS_ERR,
 			Data:   "game is over",
 		}
-		log.Errorf("Game is over %v", gameId)
+		p.Log().WithField("action", msg.Action).Errorf("Game is over %v", gameId)
 		p.SendMessage(rmsg)
 		return
 	}
@@ -234,7 +281,7 @@ func (p *Player) onReconnect(msg *Message) {
 			Status: STATUS_ERR,
 			Data:   "invalid playerId",
 		}
-		log.Errorf("Invalid player id %v", playerId)
+		p.Log().WithField("action", msg.Action).Errorf("Invalid player id %v", playerId)
 		p.SendMessage(rmsg)
 		return
 	}
@@ -247,17 +294,99 @@ func (p *Player) onReconnect(msg *Message) {
 	p.lastSendMessage = invalidPlayer.lastSendMessage
 	p.lastReceiveMessage = invalidPlayer.lastReceiveMessage
 	p.out = invalidPlayer.out
+	p.seat = invalidPlayer.seat
+	p.avatar = invalidPlayer.avatar
+	p.color = invalidPlayer.color
+	p.status = invalidPlayer.status
+	p.account = invalidPlayer.account
 
-	game.Players.Remove(invalidPlayer)
-	game.Players.Add(p)
+	game.Players.Replace(invalidPlayer, p)
 
-	log.Debugf("MSG %#v", p.lastSendMessage)
+	p.Log().WithField("action", msg.Action).Info("Reconnected")
 	if p.lastSendMessage != nil {
-		log.Debugf("MSG %#v", p.lastSendMessage)
+		p.Log().Debugf("Resend %#v", p.lastSendMessage)
 		p.SendMessage(p.lastSendMessage)
 	}
 }
 
+// onProfile sends the career stats of the account given by username, or of the player's own account.
+func (p *Player) onProfile(msg *Message) {
+	rmsg := &Message{
+		Status: STATUS_OK,
+		Event:  EVENT_GAME,
+		Action: ACTION_PROFILE,
+	}
+	if game := p.Game(); game != nil {
+		rmsg = NewEventMessage(game.Event, ACTION_PROFILE)
+	}
+
+	username := ""
+	if data, ok := msg.Data.(map[string]interface{}); ok {
+		username, _ = data["username"].(string)
+	}
+	if username == "" && p.account != nil {
+		username = p.account.Username
+	}
+
+	profile, ok := Accounts.Profile(username)
+	if !ok {
+		rmsg.Status = STATUS_ERR
+		rmsg.Data = "account not found"
+		CountActionError(msg.Action, ERROR_ACCOUNT)
+		p.SendMessage(rmsg)
+		return
+	}
+
+	rmsg.Data = profile
+	p.SendMessage(rmsg)
+}
+
+// authenticate logs the player in with the token of a create or join message. The token is replaced
+// by the account name before the message is journaled, guests can not take the name of an account.
+func (p *Player) authenticate(msg *Message) bool {
+	data, ok := msg.Data.(map[string]interface{})
+	if !ok {
+		return true
+	}
+
+	clean := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		if key != "token" && key != "account" {
+			clean[key] = value
+		}
+	}
+	msg.Data = clean
+
+	err := ""
+	if token, ok := data["token"].(string); ok {
+		p.account = Accounts.FindBySession(token)
+		if p.account == nil {
+			err = "invalid token"
+		}
+	}
+
+	if p.account != nil {
+		clean["username"] = p.account.Username
+		clean["account"] = p.account.Username
+	} else if username, _ := clean["username"].(string); err == "" && Accounts.IsReserved(username) {
+		err = "username is reserved"
+	}
+
+	if err != "" {
+		rmsg := &Message{
+			Event:  EVENT_GAME,
+			Action: msg.Action,
+			Status: STATUS_ERR,
+			Data:   err,
+		}
+		CountActionError(msg.Action, ERROR_ACCOUNT)
+		p.SendMessage(rmsg)
+		return false
+	}
+
+	return true
+}
+
 func (p *Player) OnMessage(msg *Message) {
 
 	if msg.Action == ACTION_RECONNECT {
@@ -265,21 +394,71 @@ func (p *Player) OnMessage(msg *Message) {
 		return
 	}
 
+	if msg.Action == ACTION_PROFILE {
+		p.onProfile(msg)
+		return
+	}
+
+	joining := false
 	if p.Game() == nil {
 
 		switch msg.Action {
+		case ACTION_LOBBIES:
+			Lobby.Subscribe(p)
+			return
 		case ACTION_CREATE:
+			if IsShuttingDown() {
+				rmsg := &Message{
+					Event: EVENT_GAME,
+					Action: ACTION_CREATE,
+					Status: STATUS_ERR,
+					Data:   "server is shutting down",
+				}
+				CountActionError(msg.Action, ERROR_SHUTTING_DOWN)
+				p.SendMessage(rmsg)
+				return
+			}
+			if !p.authenticate(msg) {
+				return
+			}
+			if !CanCreateGame() {
+				rmsg := &Message{
+					Event: EVENT_GAME,
+					Action: ACTION_CREATE,
+					Status: STATUS_ERR,
+					Data:   "too many games",
+				}
+				CountActionError(msg.Action, ERROR_TOO_MANY_GAMES)
+				p.SendMessage(rmsg)
+				return
+			}
+			if !GameCreations.Allow(RemoteIP(p.Addr()), Conf.Limits.GamesPerMinute) {
+				rmsg := &Message{
+					Event: EVENT_GAME,
+					Action: ACTION_CREATE,
+					Status: STATUS_ERR,
+					Data:   "too many games created, try again later",
+				}
+				CountActionError(msg.Action, ERROR_RATE_LIMITED)
+				p.SendMessage(rmsg)
+				return
+			}
+			Lobby.Unsubscribe(p)
 			game := NewGame()
 			game.Run()
-			Games[game.Id] = game
+			AddGame(game)
 			p.game = game
 			p.master = true
 			break
 		case ACTION_JOIN:
+			if !p.authenticate(msg) {
+				return
+			}
+			Lobby.Unsubscribe(p)
 			data := msg.Data.(map[string]interface{})
 			gameId := int(data["game"].(float64))
 
-			game, ok := Games[gameId]
+			game, ok := FindGame(gameId)
 
 			if !ok {
 				rmsg := &Message{
@@ -288,10 +467,13 @@ func (p *Player) OnMessage(msg *Message) {
 					Status: STATUS_ERR,
 					Data:   "invalid gameId",
 				}
+				CountActionError(msg.Action, ERROR_INVALID_GAME)
 				p.SendMessage(rmsg)
+				return
 			}
 
 			p.game = game
+			joining = true
 
 			break
 		default:
@@ -300,6 +482,7 @@ func (p *Player) OnMessage(msg *Message) {
 				Status: STATUS_ERR,
 				Data:   "invalid gameId",
 			}
+			CountActionError(msg.Action, ERROR_INVALID_GAME)
 			p.SendMessage(rmsg)
 			break
 		}
@@ -310,74 +493,96 @@ func (p *Player) OnMessage(msg *Message) {
 		return
 	}
 
+	// the event loop and the other players wait while the action changes the game
+	game := p.game
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+
+	if joining && !game.isLobby() {
+		rmsg := &Message{
+			Event: EVENT_GAME,
+			Action: ACTION_JOIN,
+			Status: STATUS_ERR,
+			Data:   "game has already started",
+		}
+		CountActionError(msg.Action, ERROR_INVALID_GAME)
+		p.SendMessage(rmsg)
+		p.game = nil
+		return
+	}
+
+	if p.game.isStopped() {
+		rmsg := &Message{
+			Event: p.game.Event.Name(),
+			Action: msg.Action,
+			Status: STATUS_ERR,
+			Data:   "game is stopped",
+		}
+		CountActionError(msg.Action, ERROR_GAME_STOPPED)
+		p.SendMessage(rmsg)
+		return
+	}
+
 	p.lastReceiveMessage = msg
+	p.game.Touch()
+	p.game.Journal.Action(p, msg)
 
 	actions := p.game.Event.Actions()
 	if action, ok := actions[msg.Action]; ok && p.Game() != nil {
+		if log.IsLevelEnabled(log.DebugLevel) {
+			p.Log().WithField("action", msg.Action).Debug("Action")
+		}
 		err := action(p.game.Players, p.game.EventsHistory, p, msg)
 		if err != nil {
-			log.Errorf("error on action: %s, id: %d, err: %v", msg.Action, p.Id(), err)
+			p.Log().WithField("action", msg.Action).Errorf("Action err: %v", err)
+			CountActionError(msg.Action, ERROR_ACTION)
 		}
 	} else {
-		log.Errorf("undefined action: %s, id: %d", msg.Action, p.Id())
+		p.Log().WithField("action", msg.Action).Error("Undefined action")
+		CountActionError(msg.Action, ERROR_UNDEFINED_ACTION)
 	}
 }
 
-func (p *Player) writeLoop() {
-	log.Debugf("writePump %d", p.Id())
-	defer func() {
-
-		if err := recover(); err != nil {
-			log.Errorf("Close writeLoop id: %d, err:%v", p.Id(), err)
-		}
-
-		log.Debugf("Closing on write end: %d", p.Id())
-		p.conn.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-p.send:
-
-			msg := &Message{}
-			errUnmarshal := json.Unmarshal(message, msg)
-			if errUnmarshal != nil {
-				log.Errorf("error on msg unmarshal id: %d, err: %v, msg: %s", p.Id(), errUnmarshal, string(message))
-			}
+// Receive passes a message from the transport to OnMessage unless the client sends too fast.
+// It returns false when the client has to be disconnected.
+func (p *Player) Receive(msg *Message) bool {
+	allowed, disconnect := p.limiter.Allow()
+	if allowed {
+		p.OnMessage(msg)
+		return true
+	}
 
-			if !ok {
-				p.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-			w, err := p.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Errorf("send message : error can't get writer connection id: %d, msg: %#v, err: %v", p.Id(), msg, err)
-				return
-			}
+	rmsg := &Message{
+		Event:  msg.Event,
+		Action: msg.Action,
+		Status: STATUS_ERR,
+		Data:   "too many messages",
+	}
+	CountActionError(msg.Action, ERROR_RATE_LIMITED)
+	p.SendMessage(rmsg)
 
-			log.Debugf("snd msg %d %#v", p.Id(), msg)
+	if disconnect {
+		p.Log().WithField("action", msg.Action).Infof("Disconnect flooding client addr: %s", p.Addr())
+	}
 
-			if _, err = w.Write(message); err != nil {
-				log.Infof("send message : error on w.Write() id: %d, msg: %#v, err: %v", p.Id(), msg, err)
-				return
-			}
+	return !disconnect
+}
 
-			if err := w.Close(); err != nil {
-				log.Infof("send message : error on w.Close() writer connection id: %d, msg: %#v, err: %v", p.Id(), msg, err)
-				return
-			}
-		}
+// Disconnect is called by a transport when the client is gone.
+func (p *Player) Disconnect() {
+	p.send.Close()
+	Clients.Remove(p)
+	if p.transport != nil {
+		Disconnects.WithLabelValues(p.transport.Name()).Inc()
+	}
+	Lobby.Unsubscribe(p)
+	if p.connectionIp != "" {
+		Connections.Release(p.connectionIp)
 	}
 }
 
 func (p *Player) CloseConnection() {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Errorf("Close client channel id: %d, err:%v", p.Id(), err)
-		}
-	}()
-
-	close(p.send)
+	p.send.Close()
 }
 
 /*
@@ -401,6 +606,33 @@ func (p *Players) FindOneById(id int) *Player {
 	return nil
 }
 
+func (p *Players) FindOneBySeat(seat int) *Player {
+	for _, player := range p.data {
+		if player.Seat() == seat && !player.Out() {
+			return player
+		}
+	}
+
+	return nil
+}
+
+// FindTarget finds the player an action targets, data is a player id or {"seat": n}.
+func (p *Players) FindTarget(data interface{}) *Player {
+	switch target := data.(type) {
+	case float64:
+		return p.FindOneById(int(target))
+	case map[string]interface{}:
+		if seat, ok := target["seat"].(float64); ok && seat > 0 {
+			return p.FindOneBySeat(int(seat))
+		}
+		if id, ok := target["id"].(float64); ok {
+			return p.FindOneById(int(id))
+		}
+	}
+
+	return nil
+}
+
 func (p *Players) FindByRole(role int) []*Player {
 	players := make([]*Player, 0)
 	for _, player := range p.data {
@@ -429,6 +661,15 @@ func (p *Players) FindOneByUsername(username string) *Player {
 	return nil
 }
 
+func (p *Players) FindMaster() *Player {
+	for _, player := range p.data {
+		if player.Master() && !player.Out() {
+			return player
+		}
+	}
+	return nil
+}
+
 func (p *Players) FindAll() []*Player {
 	players := make([]*Player, 0)
 	for _, player := range p.data {
@@ -443,15 +684,64 @@ func (p *Players) FindAllWithOut() []*Player {
 	return p.data
 }
 
+// Add seats player after the players already at the table.
 func (p *Players) Add(player *Player) {
+	player.SetSeat(len(p.data) + 1)
 	p.data = append(p.data, player)
 }
 
+// Remove frees the seat of player, the players after it move one seat up.
 func (p *Players) Remove(player *Player) {
 	for index, pl := range p.data {
 		if pl.Id() == player.Id() {
 			p.data = append(p.data[:index], p.data[index+1:]...)
+			for _, next := range p.data[index:] {
+				next.SetSeat(next.Seat() - 1)
+			}
 			break
 		}
 	}
 }
+
+// Replace puts player in the place of old, so a reconnected player keeps the seat order.
+func (p *Players) Replace(old *Player, player *Player) {
+	for index, pl := range p.data {
+		if pl.Id() == old.Id() {
+			p.data[index] = player
+			return
+		}
+	}
+	p.data = append(p.data, player)
+}
+
+// ShuffleSeats deals the seats of the seated players again in an order drawn from r.
+// Players are kept in seat order, so every players list and the role deal follow the seats.
+func (p *Players) ShuffleSeats(r *mathrand.Rand) {
+	players := p.FindAll()
+	r.Shuffle(len(players), func(i, j int) {
+		players[i], players[j] = players[j], players[i]
+	})
+
+	for index, player := range players {
+		player.SetSeat(index + 1)
+	}
+
+	for _, player := range p.data {
+		if player.Out() {
+			players = append(players, player)
+		}
+	}
+	p.data = players
+}
+
+// NewPlayerInfo is the entry of a player in the players lists.
+func NewPlayerInfo(player *Player) map[string]interface{} {
+	return map[string]interface{}{
+		"username": player.Name(),
+		"id":       player.Id(),
+		"seat":     player.Seat(),
+		"avatar":   player.Avatar(),
+		"color":    player.Color(),
+		"status":   player.Status(),
+	}
+}
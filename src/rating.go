@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+)
+
+const RATING_INITIAL = 1500
+const RATING_K = 32
+
+// Rating is an Elo rating of one side, players without games are rated RATING_INITIAL.
+type Rating struct {
+	Value float64 `json:"value"`
+	Games int     `json:"games"`
+}
+
+// Ratings are kept per side, playing mafia and playing town are different skills.
+type Ratings struct {
+	Mafia Rating `json:"mafia"`
+	Town  Rating `json:"town"`
+}
+
+type RatingsView struct {
+	Mafia int `json:"mafia"`
+	Town  int `json:"town"`
+}
+
+func (r Rating) Current() float64 {
+	if r.Games == 0 {
+		return RATING_INITIAL
+	}
+	return r.Value
+}
+
+func (r *Rating) add(delta float64) {
+	r.Value = r.Current() + delta
+	r.Games++
+}
+
+func (r Ratings) View() RatingsView {
+	return RatingsView{
+		Mafia: int(math.Round(r.Mafia.Current())),
+		Town:  int(math.Round(r.Town.Current())),
+	}
+}
+
+// RatingDelta is the Elo change of every mafia player after a game. The expected score of mafia comes
+// from the average mafia rating against the average town rating. Town players share the same total,
+// so each of them moves by -delta*mafia/town and a big town team does not inflate ratings.
+func RatingDelta(mafiaAvg float64, townAvg float64, mafiaWon bool) float64 {
+	expected := 1 / (1 + math.Pow(10, (townAvg-mafiaAvg)/400))
+	score := 0.0
+	if mafiaWon {
+		score = 1
+	}
+	return RATING_K * (score - expected)
+}
+
+// rateGame updates the side ratings of accounts, guests count with RATING_INITIAL and are not updated.
+// Called with the store locked.
+func rateGame(summary GameSummary, accounts map[int]*Account) {
+	var mafiaSum, townSum float64
+	var mafiaCount, townCount int
+	for _, result := range summary.Players {
+		rating := Ratings{}
+		if account, ok := accounts[result.Id]; ok {
+			rating = account.Ratings
+		}
+
+		if RoleTeam(result.Role) == ROLE_MAFIA {
+			mafiaSum += rating.Mafia.Current()
+			mafiaCount++
+		} else {
+			townSum += rating.Town.Current()
+			townCount++
+		}
+	}
+
+	if mafiaCount == 0 || townCount == 0 {
+		return
+	}
+
+	delta := RatingDelta(mafiaSum/float64(mafiaCount), townSum/float64(townCount), summary.Winner == ROLE_MAFIA)
+	for _, result := range summary.Players {
+		account, ok := accounts[result.Id]
+		if !ok {
+			continue
+		}
+
+		if RoleTeam(result.Role) == ROLE_MAFIA {
+			account.Ratings.Mafia.add(delta)
+		} else {
+			account.Ratings.Town.add(-delta * float64(mafiaCount) / float64(townCount))
+		}
+	}
+}
+
+// Ratings returns the ratings of account, guests get the initial ratings.
+func (s *AccountStore) Ratings(account *Account) RatingsView {
+	if account == nil {
+		return Ratings{}.View()
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return account.Ratings.View()
+}
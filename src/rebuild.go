@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Rebuild derives a game from its journal by folding the recorded inputs through the events:
+// the game entry gives the id, seed and settings, actions are applied in the order they were received,
+// timeouts expire the event they were recorded for and every event entry moves the game to the next event.
+// Messages are outputs and are not read, the rebuilt game sends them again to its own memory journal.
+// The rebuilt game is not running and not registered, its players have no transport.
+func Rebuild(entries []*JournalEntry) (*Game, error) {
+	game := NewGame()
+	game.Journal = NewMemoryJournal(game)
+
+	players := make(map[int]*Player, 0)
+
+	for i, entry := range entries {
+		var err error
+		switch entry.Kind {
+		case JOURNAL_GAME:
+			err = game.rebuildGame(entry)
+		case JOURNAL_ACTION:
+			player, ok := players[entry.Player]
+			if !ok {
+				player = NewPlayer()
+				player.id = entry.Player
+				player.discard = true
+				if data, ok := entry.Data.(map[string]interface{}); ok {
+					if name, ok := data["account"].(string); ok {
+						player.SetAccount(Accounts.FindOne(name))
+					}
+				}
+				players[entry.Player] = player
+			}
+			err = game.rebuildAction(player, entry)
+		case JOURNAL_EVENT:
+			err = game.rebuildEvent(entry)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Journal entry %d (%s %s): %v", i, entry.Kind, entry.Event, err)
+		}
+	}
+
+	return game, nil
+}
+
+func (game *Game) rebuildGame(entry *JournalEntry) error {
+	data, err := json.Marshal(entry.Data)
+	if err != nil {
+		return err
+	}
+
+	info := JournalGame{}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return err
+	}
+
+	game.Id = info.Id
+	game.Settings = info.Settings
+	game.SetSeed(info.Seed)
+
+	return nil
+}
+
+// rebuildStart processes the current event if the live game had processed it, the event loop does it on the next tick.
+func (game *Game) rebuildStart() {
+	if game.Event.Status() != NOT_IN_PROCESS {
+		return
+	}
+
+	err := game.Event.Process(game.Players, game.EventsHistory)
+	if err != nil {
+		game.Log().Warningf("Process err: %v", err)
+	}
+}
+
+func (game *Game) rebuildAction(player *Player, entry *JournalEntry) error {
+	// a leave clears the game of the player, every action is sent to the game as OnMessage does
+	player.SetGame(game)
+
+	if entry.EventStatus != NOT_IN_PROCESS {
+		game.rebuildStart()
+	}
+
+	if entry.Action == ACTION_CREATE && game.Event.Name() == EVENT_GAME {
+		player.SetMaster(true)
+	}
+
+	msg := &Message{
+		Event:     entry.Event,
+		Iteration: entry.Iteration,
+		Action:    entry.Action,
+		Data:      entry.Data,
+	}
+	game.Journal.Action(player, msg)
+
+	action, ok := game.Event.Actions()[entry.Action]
+	if !ok {
+		return nil
+	}
+
+	err := action(game.Players, game.EventsHistory, player, msg)
+	if err != nil {
+		player.Log().WithField("action", entry.Action).Debugf("Action err: %v", err)
+	}
+
+	return nil
+}
+
+func (game *Game) rebuildEvent(entry *JournalEntry) error {
+	game.rebuildStart()
+
+	if data, ok := entry.Data.(map[string]interface{}); ok && data["timeout"] == true {
+		if game.Event.Name() != entry.Event {
+			return fmt.Errorf("timeout of %s while the event is %s", entry.Event, game.Event.Name())
+		}
+		game.timeoutEvent()
+		return nil
+	}
+
+	if game.Event.Status() != PROCESSED {
+		return fmt.Errorf("event %s is not processed", game.Event.Name())
+	}
+
+	if err := game.SetNextEvent(); err != nil {
+		return err
+	}
+
+	if game.Event.Name() != entry.Event || game.Event.Iteration() != entry.Iteration {
+		return fmt.Errorf("next event is %s %d", game.Event.Name(), game.Event.Iteration())
+	}
+
+	// the seed of game_start is the one of the game entry, only a rematch draws a new one
+	if data, ok := entry.Data.(map[string]interface{}); ok && data["rematch"] == true {
+		if seed, ok := data["seed"].(string); ok {
+			value, err := strconv.ParseInt(seed, 10, 64)
+			if err != nil {
+				return err
+			}
+			game.SetSeed(value)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// playBot votes for a random player whenever it gets the list of players, other events time out.
+func playBot(player *Player) {
+	go func() {
+		for {
+			item, ok := player.send.Wait()
+			if !ok {
+				return
+			}
+
+			msg := item.Message
+			if msg.Action != ACTION_PLAYERS || (msg.Event != EVENT_MAFIA && msg.Event != EVENT_COURT) {
+				continue
+			}
+
+			candidates := make([]int, 0)
+			for _, info := range msg.Data.([]interface{}) {
+				id := info.(map[string]interface{})["id"].(int)
+				if id != player.Id() {
+					candidates = append(candidates, id)
+				}
+			}
+			if len(candidates) == 0 {
+				continue
+			}
+
+			player.OnMessage(&Message{
+				Event:     msg.Event,
+				Iteration: msg.Iteration,
+				Action:    ACTION_VOTE,
+				Data:      float64(candidates[rand.Intn(len(candidates))]),
+			})
+		}
+	}()
+}
+
+// gameOutcome describes the state a replay must reproduce.
+func gameOutcome(game *Game) string {
+	outcome := fmt.Sprintf("event: %s, iteration: %d, winner: %d", game.Event.Name(), game.Iteration, game.Winner)
+	for _, player := range game.Players.FindAllWithOut() {
+		outcome += fmt.Sprintf("; %d %s role: %d out: %v master: %v", player.Id(), player.Name(), player.Role(), player.Out(), player.Master())
+	}
+	return outcome
+}
+
+// playBotGame plays a 7 player game with bots until game over.
+func playBotGame(t *testing.T) *Game {
+	timeouts, roles := Conf.Timeouts, Conf.Roles
+	t.Cleanup(func() { Conf.Timeouts, Conf.Roles = timeouts, roles })
+	Conf.Roles = RoleSetup{MafiaDivisor: 3}
+	Conf.Timeouts.Accept = 2 * time.Millisecond
+	Conf.Timeouts.Vote = 100 * time.Millisecond
+
+	master := NewPlayer()
+	master.OnMessage(&Message{
+		Event:  EVENT_GAME,
+		Action: ACTION_CREATE,
+		Data:   map[string]interface{}{"username": "master", "max_players": float64(8)},
+	})
+	game := master.Game()
+	stopGame(t, game)
+	playBot(master)
+
+	for i := 0; i < 6; i++ {
+		player := NewPlayer()
+		playBot(player)
+		player.OnMessage(&Message{
+			Event:  EVENT_GAME,
+			Action: ACTION_JOIN,
+			Data:   map[string]interface{}{"username": strconv.Itoa(i), "game": float64(game.Id)},
+		})
+	}
+
+	master.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_START})
+
+	over := func() (over bool) {
+		locked(game, func() { over = !game.FinishedAt.IsZero() && game.Event.Status() != NOT_IN_PROCESS })
+		return over
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !over() {
+		if time.Now().After(deadline) {
+			outcome := ""
+			locked(game, func() { outcome = gameOutcome(game) })
+			t.Fatalf("Game is not over: %s", outcome)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return game
+}
+
+func TestRebuild(t *testing.T) {
+	game := playBotGame(t)
+	locked(game, game.Stop)
+	RemoveGame(game)
+
+	votes := 0
+	for _, entry := range game.Journal.Entries() {
+		if entry.Kind == JOURNAL_ACTION && entry.Action == ACTION_VOTE {
+			votes++
+		}
+	}
+	if votes == 0 {
+		t.Errorf("Game must have votes")
+	}
+
+	stored, err := ReadJournal(game.Id)
+	if err != nil {
+		t.Fatalf("Read journal err: %v", err)
+	}
+
+	for _, entry := range stored {
+		data, _ := entry.Data.(map[string]interface{})
+		if entry.Kind != JOURNAL_EVENT || entry.Event != EVENT_GAME_START || data["timeout"] == true {
+			continue
+		}
+		if data["seed"] != strconv.FormatInt(game.Seed, 10) {
+			t.Errorf("Seed of game_start must be kept exactly %v, must be %d", data["seed"], game.Seed)
+		}
+	}
+
+	for name, entries := range map[string][]*JournalEntry{"memory": game.Journal.Entries(), "disk": stored} {
+		rebuilt, err := Rebuild(entries)
+		if err != nil {
+			t.Errorf("Rebuild from %s err: %v", name, err)
+			continue
+		}
+
+		if rebuilt.Id != game.Id || rebuilt.Seed != game.Seed {
+			t.Errorf("Rebuild from %s has game %d seed %d, must be %d seed %d", name, rebuilt.Id, rebuilt.Seed, game.Id, game.Seed)
+		}
+
+		if gameOutcome(rebuilt) != gameOutcome(game) {
+			t.Errorf("Rebuild from %s differs\n got: %s\nmust: %s", name, gameOutcome(rebuilt), gameOutcome(game))
+		}
+
+		summary := fmt.Sprintf("%+v", NewGameSummary(rebuilt.Winner, rebuilt.Players, rebuilt.EventsHistory))
+		if summary != fmt.Sprintf("%+v", NewGameSummary(game.Winner, game.Players, game.EventsHistory)) {
+			t.Errorf("Summary of the rebuild from %s differs: %s", name, summary)
+		}
+
+		for _, player := range rebuilt.Players.FindAllWithOut() {
+			if player.send.Len() != 0 || player.send.Overflowed() {
+				t.Errorf("Rebuilt players must not queue messages")
+			}
+		}
+	}
+}
+
+func TestRematch(t *testing.T) {
+	game := playBotGame(t)
+
+	var master, player *Player
+	for _, p := range game.Players.FindAllWithOut() {
+		if p.Master() {
+			master = p
+		} else {
+			player = p
+		}
+	}
+
+	player.OnMessage(&Message{Event: EVENT_GAME_OVER, Action: ACTION_REMATCH})
+	time.Sleep(5 * time.Millisecond)
+	if event, _ := currentEvent(game); event.Name() != EVENT_GAME_OVER {
+		t.Fatalf("Rematch must wait for the master")
+	}
+
+	master.OnMessage(&Message{Event: EVENT_GAME_OVER, Action: ACTION_REMATCH})
+	lobby := func() (lobby bool) {
+		locked(game, func() { lobby = game.isLobby() })
+		return lobby
+	}
+	if !waitFor(lobby) {
+		event, _ := currentEvent(game)
+		t.Fatalf("Rematch must return the game to the lobby, event: %s", event.Name())
+	}
+
+	if game.Iteration != 1 || game.Winner != 0 || !game.FinishedAt.IsZero() || len(game.EventsHistory.FindAll()) != 0 {
+		t.Errorf("Game must be reset: iteration %d winner %d", game.Iteration, game.Winner)
+	}
+
+	for _, p := range game.Players.FindAllWithOut() {
+		if p.Out() || p.Role() != 0 {
+			t.Errorf("Player must be back in the lobby without a role %d", p.Id())
+		}
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/games/{id}/replay", apiReplayGame)
+	r.HandleFunc("/games/{id}/summary", apiGameSummary)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/games/"+strconv.Itoa(game.Id)+"/replay", nil))
+	replay := ReplayView{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &replay) != nil || len(replay.Entries) != len(game.Previous.Entries) {
+		t.Errorf("Replay after rematch must return the finished game, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/games/"+strconv.Itoa(game.Id)+"/summary", nil))
+	summary := GameSummary{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &summary) != nil || summary.Winner == 0 || summary.Players[0].Role == 0 {
+		t.Errorf("Summary after rematch must return the finished game, got %d %s", w.Code, w.Body.String())
+	}
+
+	rebuilt, err := Rebuild(game.Journal.Entries())
+	if err != nil {
+		t.Fatalf("Rebuild after rematch err: %v", err)
+	}
+	outcome := ""
+	locked(game, func() { outcome = gameOutcome(game) })
+	if rebuilt.Seed != game.Seed || gameOutcome(rebuilt) != outcome {
+		t.Errorf("Rebuild after rematch differs\n got: %s\nmust: %s", gameOutcome(rebuilt), outcome)
+	}
+}
+
+func TestRebuildLeaveAndJoin(t *testing.T) {
+	master := NewPlayer()
+	master.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: map[string]interface{}{"username": "master"}})
+	game := master.Game()
+	stopGame(t, game)
+
+	player := NewPlayer()
+	join := func() {
+		player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_JOIN, Data: map[string]interface{}{"username": "anton", "game": float64(game.Id)}})
+	}
+	join()
+	player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_LEAVE})
+	join()
+
+	if player.Game() != game {
+		t.Fatalf("Player must join again after leaving")
+	}
+
+	rebuilt, err := Rebuild(game.Journal.Entries())
+	if err != nil {
+		t.Fatalf("Rebuild err: %v", err)
+	}
+	if gameOutcome(rebuilt) != gameOutcome(game) {
+		t.Errorf("Rebuild after leave and join differs\n got: %s\nmust: %s", gameOutcome(rebuilt), gameOutcome(game))
+	}
+}
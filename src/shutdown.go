@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownNoticeEvery is how often players are reminded of the remaining time.
+const shutdownNoticeEvery = 10 * time.Second
+
+// shutdownDrainTimeout bounds the wait for queued messages to be written before connections are closed.
+const shutdownDrainTimeout = 2 * time.Second
+
+var shuttingDown int32
+
+// IsShuttingDown reports whether the server has stopped accepting new games.
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// WaitForSignal blocks until the process gets SIGTERM or SIGINT.
+func WaitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	return <-signals
+}
+
+// Shutdown stops accepting new games, aborts lobbies, waits up to timeout for running games
+// to finish while counting down to players, then closes every connection and the server.
+func Shutdown(server *http.Server, timeout time.Duration) {
+	atomic.StoreInt32(&shuttingDown, 1)
+	deadline := time.Now().Add(timeout)
+	log.Infof("Shutdown, wait for running games until %s", deadline.Format(time.RFC3339))
+
+	for _, game := range FindGames() {
+		if game.isLobby() {
+			log.Infof("Abort lobby id: %d", game.Id)
+			game.Abort()
+			RemoveGame(game)
+		}
+	}
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+
+	var noticeAt time.Time
+	for {
+		running := RunningGames()
+		if running == 0 || !time.Now().Before(deadline) {
+			if running != 0 {
+				log.Warnf("Shutdown deadline, %d games are still running", running)
+			}
+			break
+		}
+
+		if time.Since(noticeAt) >= shutdownNoticeEvery {
+			noticeAt = time.Now()
+			NotifyShutdown(time.Until(deadline))
+		}
+
+		<-t.C
+	}
+
+	NotifyShutdown(0)
+	for _, game := range FindGames() {
+		game.Stop()
+	}
+
+	if !DrainQueues(shutdownDrainTimeout) {
+		log.Warnf("Shutdown, outbound queues are not drained")
+	}
+
+	for _, player := range Clients.FindAll() {
+		if transport := player.Transport(); transport != nil {
+			transport.Close()
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Errorf("Server shutdown error: %v", err)
+	}
+
+	log.Infof("Shutdown done")
+}
+
+// RunningGames counts started games that are not over yet.
+func RunningGames() int {
+	running := 0
+	for _, game := range FindGames() {
+		if !game.isStopped() && !game.isLobby() && game.FinishedAt.IsZero() {
+			running++
+		}
+	}
+	return running
+}
+
+// DrainQueues waits up to timeout until no connected player has queued messages,
+// so the last countdown and game over messages are written before the connections close.
+func DrainQueues(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		drained := true
+		for _, player := range Clients.FindAll() {
+			if player.send.Len() != 0 {
+				drained = false
+				break
+			}
+		}
+
+		if drained {
+			return true
+		}
+
+		if !time.Now().Before(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// NotifyShutdown sends every connected player the seconds left before the server closes.
+func NotifyShutdown(left time.Duration) {
+	seconds := int(left.Round(time.Second) / time.Second)
+	for _, player := range Clients.FindAll() {
+		rmsg := &Message{
+			Status: STATUS_OK,
+			Event:  EVENT_GAME,
+			Action: ACTION_SERVER_SHUTDOWN,
+			Data:   map[string]interface{}{"seconds": seconds},
+		}
+		if game := player.Game(); game != nil {
+			game.mutex.Lock()
+			rmsg = NewEventMessage(game.Event, ACTION_SERVER_SHUTDOWN)
+			game.mutex.Unlock()
+			rmsg.Data = map[string]interface{}{"seconds": seconds}
+		}
+		player.SendMessage(rmsg)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowTransport takes queued messages with a delay, like a slow client, and keeps what it got before Close.
+type slowTransport struct {
+	mutex   sync.Mutex
+	written []*Message
+	closed  bool
+}
+
+func (t *slowTransport) Name() string {
+	return "slow"
+}
+
+func (t *slowTransport) Run(player *Player) {
+	go func() {
+		for {
+			time.Sleep(5 * time.Millisecond)
+
+			t.mutex.Lock()
+			if t.closed {
+				t.mutex.Unlock()
+				return
+			}
+			if item, ok := player.send.Pop(); ok {
+				t.written = append(t.written, item.Message)
+			}
+			t.mutex.Unlock()
+		}
+	}()
+}
+
+func (t *slowTransport) Close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.closed = true
+}
+
+func (t *slowTransport) Written() []*Message {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.written
+}
+
+func shutdownSeconds(msg *Message) (int, bool) {
+	if msg.Action != ACTION_SERVER_SHUTDOWN {
+		return 0, false
+	}
+	seconds, ok := msg.Data.(map[string]interface{})["seconds"].(int)
+	return seconds, ok
+}
+
+func TestShutdown(t *testing.T) {
+	t.Cleanup(func() { atomic.StoreInt32(&shuttingDown, 0) })
+
+	connect := func() (*Player, *slowTransport) {
+		transport := &slowTransport{}
+		player := NewPlayer()
+		player.SetTransport(transport)
+		t.Cleanup(player.Disconnect)
+		return player, transport
+	}
+
+	master, masterTransport := connect()
+	master.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: map[string]interface{}{"username": "master"}})
+	lobby := master.Game()
+	t.Cleanup(func() { lobby.Stop(); RemoveGame(lobby) })
+
+	player, playerTransport := connect()
+	started := NewGame()
+	started.Event = NewAcceptEvent(started.Iteration, EVENT_DAY, ACTION_START)
+	player.SetGame(started)
+	started.Players.Add(player)
+	AddGame(started)
+	t.Cleanup(func() { RemoveGame(started) })
+
+	Shutdown(&http.Server{}, 0)
+
+	if !IsShuttingDown() {
+		t.Errorf("Server must be shutting down")
+	}
+
+	if _, ok := FindGame(lobby.Id); ok || !lobby.isStopped() {
+		t.Errorf("Lobby must be aborted and removed")
+	}
+
+	if !started.isStopped() {
+		t.Errorf("Running game must be stopped after the deadline")
+	}
+
+	aborted := false
+	for _, msg := range masterTransport.Written() {
+		aborted = aborted || msg.Action == ACTION_ABORT
+	}
+	if !aborted {
+		t.Errorf("Lobby master must get the abort before the connection is closed")
+	}
+
+	written := playerTransport.Written()
+	if len(written) == 0 {
+		t.Fatalf("Player must get the shutdown notice before the connection is closed")
+	}
+	if seconds, ok := shutdownSeconds(written[len(written)-1]); !ok || seconds != 0 {
+		t.Errorf("Last message must be the shutdown notice with 0 seconds, got %#v", written[len(written)-1])
+	}
+
+	w := httptest.NewRecorder()
+	readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Readyz must fail while shutting down, got %d", w.Code)
+	}
+
+	refused := NewPlayer()
+	refused.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: map[string]interface{}{"username": "late"}})
+	item, ok := refused.send.Pop()
+	if !ok || item.Message.Status != STATUS_ERR || refused.Game() != nil {
+		t.Errorf("Create must be refused while shutting down")
+	}
+}
+
+func TestDrainQueues(t *testing.T) {
+	player := NewPlayer()
+	Clients.Add(player)
+	t.Cleanup(func() { Clients.Remove(player) })
+
+	player.SendMessage(&Message{Event: EVENT_GAME, Action: ACTION_SERVER_SHUTDOWN, Status: STATUS_OK})
+	if DrainQueues(20 * time.Millisecond) {
+		t.Errorf("Queue nobody reads must not be drained")
+	}
+
+	player.send.Pop()
+	if !DrainQueues(20 * time.Millisecond) {
+		t.Errorf("Empty queues must be drained")
+	}
+}
+
+func TestRunningGames(t *testing.T) {
+	before := RunningGames()
+
+	add := func(event string) *Game {
+		game := NewGame()
+		if event != EVENT_GAME {
+			game.Event = NewAcceptEvent(game.Iteration, event, ACTION_START)
+		}
+		AddGame(game)
+		t.Cleanup(func() { RemoveGame(game) })
+		return game
+	}
+
+	add(EVENT_GAME)
+	add(EVENT_DAY)
+	add(EVENT_NIGHT).FinishedAt = time.Now()
+	add(EVENT_NIGHT).Stop()
+
+	if running := RunningGames() - before; running != 1 {
+		t.Errorf("Only the started game must be running, got %d", running)
+	}
+}
+
+func TestNotifyShutdown(t *testing.T) {
+	idle := NewPlayer()
+	Clients.Add(idle)
+	t.Cleanup(func() { Clients.Remove(idle) })
+
+	game := NewGame()
+	game.Event = NewAcceptEvent(game.Iteration, EVENT_DAY, ACTION_START)
+	playing := NewPlayer()
+	playing.SetGame(game)
+	Clients.Add(playing)
+	t.Cleanup(func() { Clients.Remove(playing) })
+
+	NotifyShutdown(90*time.Second + 400*time.Millisecond)
+
+	for _, check := range []struct {
+		player *Player
+		event  string
+	}{{idle, EVENT_GAME}, {playing, EVENT_DAY}} {
+		item, ok := check.player.send.Pop()
+		if !ok {
+			t.Fatalf("Player must get the shutdown notice")
+		}
+		if seconds, ok := shutdownSeconds(item.Message); !ok || seconds != 90 || item.Message.Event != check.event {
+			t.Errorf("Shutdown notice must have 90 seconds and the event %s, got %#v", check.event, item.Message)
+		}
+		if item, _ := check.player.send.Pop(); item != nil {
+			t.Errorf("Shutdown notice must be sent once")
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const leaderboardLimit = 20
+const leaderboardMaxLimit = 100
+
+// CareerStats is the record of an account over every finished game, stored with the account.
+type CareerStats struct {
+	Games                  int                     `json:"games"`
+	Wins                   int                     `json:"wins"`
+	Survived               int                     `json:"survived"`
+	CourtVotes             int                     `json:"court_votes"`
+	CourtVotesAgainstMafia int                     `json:"court_votes_against_mafia"`
+	Teams                  map[string]*RecordStats `json:"teams"`
+	Roles                  map[string]*RecordStats `json:"roles"`
+}
+
+type RecordStats struct {
+	Games int `json:"games"`
+	Wins  int `json:"wins"`
+}
+
+type RecordView struct {
+	Games   int     `json:"games"`
+	Wins    int     `json:"wins"`
+	WinRate float64 `json:"win_rate"`
+}
+
+// ProfileView is served by the profile action and the leaderboard, rates are between 0 and 1.
+type ProfileView struct {
+	Username      string                `json:"username"`
+	CreatedAt     time.Time             `json:"created_at"`
+	Games         int                   `json:"games"`
+	Wins          int                   `json:"wins"`
+	WinRate       float64               `json:"win_rate"`
+	SurvivalRate  float64               `json:"survival_rate"`
+	CourtAccuracy float64               `json:"court_accuracy"`
+	Teams         map[string]RecordView `json:"teams"`
+	Roles         map[string]RecordView `json:"roles"`
+	Ratings       RatingsView           `json:"ratings"`
+}
+
+func RoleName(role int) string {
+	switch role {
+	case ROLE_CITIZEN:
+		return "citizen"
+	case ROLE_MAFIA:
+		return "mafia"
+	case ROLE_DOCTOR:
+		return "doctor"
+	case ROLE_GIRL:
+		return "girl"
+	case ROLE_SHERIFF:
+		return "sheriff"
+	}
+	return "none"
+}
+
+// RoleTeam is ROLE_MAFIA for mafia and ROLE_CITIZEN for every other role.
+func RoleTeam(role int) int {
+	if role == ROLE_MAFIA {
+		return ROLE_MAFIA
+	}
+	return ROLE_CITIZEN
+}
+
+func ratio(count int, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(count) / float64(total)
+}
+
+func (r *RecordStats) add(win bool) {
+	r.Games++
+	if win {
+		r.Wins++
+	}
+}
+
+func record(records map[string]*RecordStats, key string) *RecordStats {
+	if _, ok := records[key]; !ok {
+		records[key] = &RecordStats{}
+	}
+	return records[key]
+}
+
+func recordViews(records map[string]*RecordStats) map[string]RecordView {
+	views := make(map[string]RecordView, len(records))
+	for key, r := range records {
+		views[key] = RecordView{Games: r.Games, Wins: r.Wins, WinRate: ratio(r.Wins, r.Games)}
+	}
+	return views
+}
+
+func NewProfileView(account *Account) ProfileView {
+	stats := account.Stats
+	return ProfileView{
+		Username:      account.Username,
+		CreatedAt:     account.CreatedAt,
+		Games:         stats.Games,
+		Wins:          stats.Wins,
+		WinRate:       ratio(stats.Wins, stats.Games),
+		SurvivalRate:  ratio(stats.Survived, stats.Games),
+		CourtAccuracy: ratio(stats.CourtVotesAgainstMafia, stats.CourtVotes),
+		Teams:         recordViews(stats.Teams),
+		Roles:         recordViews(stats.Roles),
+		Ratings:       account.Ratings.View(),
+	}
+}
+
+// RecordGame adds a finished game to the stats and ratings of every player who played it logged in.
+func (s *AccountStore) RecordGame(game *Game) error {
+	summary := NewGameSummary(game.Winner, game.Players, game.EventsHistory)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	accounts := make(map[int]*Account, 0)
+	for _, player := range game.Players.FindAllWithOut() {
+		if player.Account() != nil {
+			accounts[player.Id()] = player.Account()
+		}
+	}
+
+	recorded := false
+	for _, result := range summary.Players {
+		account, ok := accounts[result.Id]
+		if !ok {
+			continue
+		}
+
+		stats := &account.Stats
+		if stats.Teams == nil {
+			stats.Teams = make(map[string]*RecordStats, 0)
+		}
+		if stats.Roles == nil {
+			stats.Roles = make(map[string]*RecordStats, 0)
+		}
+
+		win := RoleTeam(result.Role) == summary.Winner
+		stats.Games++
+		if win {
+			stats.Wins++
+		}
+		if !result.Out {
+			stats.Survived++
+		}
+		stats.CourtVotes += result.Stats.CourtVotes
+		stats.CourtVotesAgainstMafia += result.Stats.CourtVotesAgainstMafia
+		record(stats.Teams, WinnerTeam(RoleTeam(result.Role))).add(win)
+		record(stats.Roles, RoleName(result.Role)).add(win)
+		recorded = true
+	}
+
+	if !recorded {
+		return nil
+	}
+	rateGame(summary, accounts)
+
+	return s.save()
+}
+
+// Profile returns the profile of the account username.
+func (s *AccountStore) Profile(username string) (ProfileView, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	account, ok := s.data[accountKey(username)]
+	if !ok {
+		return ProfileView{}, false
+	}
+	return NewProfileView(account), true
+}
+
+// Leaderboard ranks accounts that played by wins, then win rate, then name.
+func (s *AccountStore) Leaderboard(limit int) []ProfileView {
+	s.mutex.Lock()
+	profiles := make([]ProfileView, 0)
+	for _, account := range s.data {
+		if account.Stats.Games > 0 {
+			profiles = append(profiles, NewProfileView(account))
+		}
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].Wins != profiles[j].Wins {
+			return profiles[i].Wins > profiles[j].Wins
+		}
+		if profiles[i].WinRate != profiles[j].WinRate {
+			return profiles[i].WinRate > profiles[j].WinRate
+		}
+		return accountKey(profiles[i].Username) < accountKey(profiles[j].Username)
+	})
+
+	if len(profiles) > limit {
+		profiles = profiles[:limit]
+	}
+	return profiles
+}
+
+// apiLeaderboard serves GET /leaderboard?limit=N.
+func apiLeaderboard(w http.ResponseWriter, r *http.Request) {
+	limit := leaderboardLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > leaderboardMaxLimit {
+			writeError(w, http.StatusBadRequest, "limit must be 1 to "+strconv.Itoa(leaderboardMaxLimit))
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, Accounts.Leaderboard(limit))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCareerStats(t *testing.T) {
+	accounts := Accounts
+	defer func() { Accounts = accounts }()
+	Accounts = NewAccountStore("")
+
+	alice, _ := Accounts.Register("Alice", "secret password")
+	bob, _ := Accounts.Register("Bob", "secret password")
+
+	game := NewGame()
+	game.Iteration = 2
+
+	mafia := NewPlayer()
+	mafia.SetAccount(alice)
+	mafia.SetRole(ROLE_MAFIA)
+
+	citizen := NewPlayer()
+	citizen.SetAccount(bob)
+	citizen.SetRole(ROLE_CITIZEN)
+
+	guest := NewPlayer()
+	guest.SetRole(ROLE_CITIZEN)
+
+	for _, player := range []*Player{mafia, citizen, guest} {
+		player.SetGame(game)
+		game.Players.Add(player)
+	}
+
+	court := NewCourtEvent(game.Iteration)
+	court.AddVoted(citizen, mafia)
+	court.AddVoted(guest, mafia)
+	court.AddVoted(mafia, guest)
+	game.EventsHistory.Push(court)
+	mafia.SetOut(true)
+	game.Winner = ROLE_CITIZEN
+
+	if err := Accounts.RecordGame(game); err != nil {
+		t.Fatalf("Record game err: %v", err)
+	}
+
+	profile, _ := Accounts.Profile("alice")
+	if profile.Games != 1 || profile.Wins != 0 || profile.SurvivalRate != 0 || profile.Roles["mafia"].Games != 1 {
+		t.Errorf("Wrong mafia profile %#v", profile)
+	}
+
+	profile, _ = Accounts.Profile("bob")
+	if profile.Wins != 1 || profile.CourtAccuracy != 1 || profile.Teams["citizen"].WinRate != 1 {
+		t.Errorf("Wrong citizen profile %#v", profile)
+	}
+
+	if ratings := Accounts.Ratings(alice); ratings.Mafia != 1484 || ratings.Town != RATING_INITIAL {
+		t.Errorf("Losing mafia must lose K/2 against an equal town %#v", ratings)
+	}
+
+	if ratings := Accounts.Ratings(bob); ratings.Town != 1508 {
+		t.Errorf("Two town players must share what mafia lost %#v", ratings)
+	}
+
+	if RatingDelta(1700, 1500, true) >= RatingDelta(1500, 1500, true) {
+		t.Errorf("Beating a weaker town must gain less")
+	}
+
+	leaderboard := Accounts.Leaderboard(10)
+	if len(leaderboard) != 2 || leaderboard[0].Username != "Bob" {
+		t.Errorf("Wrong leaderboard %#v", leaderboard)
+	}
+
+	w := httptest.NewRecorder()
+	apiLeaderboard(w, httptest.NewRequest("GET", "/leaderboard?limit=1", nil))
+	views := make([]ProfileView, 0)
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &views) != nil || len(views) != 1 {
+		t.Errorf("Wrong leaderboard response %d %s", w.Code, w.Body.String())
+	}
+
+	player := NewPlayer()
+	player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_PROFILE, Data: map[string]interface{}{"username": "Bob"}})
+	item, _ := player.send.Pop()
+	if view, ok := item.Message.Data.(ProfileView); !ok || view.Username != "Bob" || view.Wins != 1 {
+		t.Errorf("Wrong profile message %#v", item.Message)
+	}
+
+	player.OnMessage(&Message{Event: EVENT_GAME, Action: ACTION_PROFILE})
+	item, _ = player.send.Pop()
+	if item.Message.Status != STATUS_ERR {
+		t.Errorf("Guest without username must get an error %#v", item.Message)
+	}
+}
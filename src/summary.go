@@ -0,0 +1,200 @@
+package main
+
+import (
+	"sort"
+)
+
+const OUT_BY_MAFIA = "mafia"
+const OUT_BY_COURT = "court"
+
+// GameSummary is sent with the summary action at game over and served by GET /games/{id}/summary.
+// Players are referenced by id, 0 means nobody.
+type GameSummary struct {
+	Winner     int             `json:"winner"`
+	Iterations int             `json:"iterations"`
+	Players    []PlayerSummary `json:"players"`
+	Nights     []NightSummary  `json:"nights"`
+	Courts     []CourtSummary  `json:"courts"`
+}
+
+type PlayerSummary struct {
+	Id           int         `json:"id"`
+	Username     string      `json:"username"`
+	Seat         int         `json:"seat"`
+	Role         int         `json:"role"`
+	Out          bool        `json:"out"`
+	OutBy        string      `json:"out_by,omitempty"`
+	OutIteration int         `json:"out_iteration,omitempty"`
+	Stats        PlayerStats `json:"stats"`
+}
+
+// PlayerStats counts what a player did for the team: sheriff checks, doctor saves,
+// girl blocks of the mafia target and court votes against mafia.
+type PlayerStats struct {
+	Checks                 int `json:"checks,omitempty"`
+	MafiaFound             int `json:"mafia_found,omitempty"`
+	Saves                  int `json:"saves,omitempty"`
+	Blocks                 int `json:"blocks,omitempty"`
+	CourtVotes             int `json:"court_votes,omitempty"`
+	CourtVotesAgainstMafia int `json:"court_votes_against_mafia,omitempty"`
+}
+
+type NightSummary struct {
+	Iteration    int  `json:"iteration"`
+	MafiaTarget  int  `json:"mafia_target,omitempty"`
+	DoctorSave   int  `json:"doctor_save,omitempty"`
+	GirlBlock    int  `json:"girl_block,omitempty"`
+	SheriffCheck int  `json:"sheriff_check,omitempty"`
+	SheriffFound bool `json:"sheriff_found,omitempty"`
+	Killed       int  `json:"killed,omitempty"`
+}
+
+type CourtSummary struct {
+	Iteration int         `json:"iteration"`
+	Votes     []CourtVote `json:"votes"`
+	Tally     map[int]int `json:"tally"`
+	Out       int         `json:"out,omitempty"`
+}
+
+type CourtVote struct {
+	Player int `json:"player"`
+	Vote   int `json:"vote"`
+}
+
+func playerId(player *Player) int {
+	if player == nil {
+		return 0
+	}
+	return player.Id()
+}
+
+// NewGameSummary folds the events played so far into the summary of the game.
+func NewGameSummary(winner int, players *Players, history *EventHistory) GameSummary {
+	summary := GameSummary{
+		Winner:  winner,
+		Players: make([]PlayerSummary, 0),
+		Nights:  make([]NightSummary, 0),
+		Courts:  make([]CourtSummary, 0),
+	}
+
+	index := make(map[int]int, 0)
+	for _, player := range players.FindAllWithOut() {
+		index[player.Id()] = len(summary.Players)
+		summary.Players = append(summary.Players, PlayerSummary{
+			Id:       player.Id(),
+			Username: player.Name(),
+			Seat:     player.Seat(),
+			Role:     player.Role(),
+			Out:      player.Out(),
+		})
+	}
+
+	stats := func(id int) *PlayerStats {
+		if i, ok := index[id]; ok {
+			return &summary.Players[i].Stats
+		}
+		return &PlayerStats{}
+	}
+
+	holder := func(role int) int {
+		for _, player := range players.FindAllWithOut() {
+			if player.Role() == role {
+				return player.Id()
+			}
+		}
+		return 0
+	}
+
+	setOut := func(id int, by string, iteration int) {
+		if i, ok := index[id]; ok {
+			summary.Players[i].OutBy = by
+			summary.Players[i].OutIteration = iteration
+		}
+	}
+
+	night := func(iteration int) *NightSummary {
+		for i := range summary.Nights {
+			if summary.Nights[i].Iteration == iteration {
+				return &summary.Nights[i]
+			}
+		}
+		summary.Nights = append(summary.Nights, NightSummary{Iteration: iteration})
+		return &summary.Nights[len(summary.Nights)-1]
+	}
+
+	for _, event := range history.FindAll() {
+		if event.Iteration() > summary.Iterations {
+			summary.Iterations = event.Iteration()
+		}
+
+		switch e := event.(type) {
+		case *MafiaEvent:
+			night(e.Iteration()).MafiaTarget = playerId(e.Candidate())
+		case *DoctorEvent:
+			night(e.Iteration()).DoctorSave = playerId(e.Choice())
+		case *GirlEvent:
+			night(e.Iteration()).GirlBlock = playerId(e.Choice())
+		case *SheriffEvent:
+			if e.Choice() != nil {
+				n := night(e.Iteration())
+				n.SheriffCheck = e.Choice().Id()
+				n.SheriffFound = e.Choice().Role() == ROLE_MAFIA
+			}
+		case *NightResultEvent:
+			if e.Killed() != nil {
+				night(e.Iteration()).Killed = e.Killed().Id()
+				setOut(e.Killed().Id(), OUT_BY_MAFIA, e.Iteration())
+			}
+		case *CourtEvent:
+			court := CourtSummary{
+				Iteration: e.Iteration(),
+				Votes:     make([]CourtVote, 0),
+				Tally:     make(map[int]int, 0),
+			}
+			for voter, vote := range e.voted {
+				court.Votes = append(court.Votes, CourtVote{Player: voter.Id(), Vote: vote.Id()})
+				court.Tally[vote.Id()]++
+
+				voterStats := stats(voter.Id())
+				voterStats.CourtVotes++
+				if vote.Role() == ROLE_MAFIA {
+					voterStats.CourtVotesAgainstMafia++
+				}
+			}
+			sort.Slice(court.Votes, func(i, j int) bool {
+				return court.Votes[i].Player < court.Votes[j].Player
+			})
+			summary.Courts = append(summary.Courts, court)
+		case *CourtResultEvent:
+			if e.Convicted() != nil {
+				for i := range summary.Courts {
+					if summary.Courts[i].Iteration == e.Iteration() {
+						summary.Courts[i].Out = e.Convicted().Id()
+					}
+				}
+				setOut(e.Convicted().Id(), OUT_BY_COURT, e.Iteration())
+			}
+		}
+	}
+
+	for _, n := range summary.Nights {
+		if n.SheriffCheck != 0 {
+			sheriff := stats(holder(ROLE_SHERIFF))
+			sheriff.Checks++
+			if n.SheriffFound {
+				sheriff.MafiaFound++
+			}
+		}
+		if n.MafiaTarget == 0 {
+			continue
+		}
+		if n.DoctorSave == n.MafiaTarget {
+			stats(holder(ROLE_DOCTOR)).Saves++
+		}
+		if n.GirlBlock == n.MafiaTarget {
+			stats(holder(ROLE_GIRL)).Blocks++
+		}
+	}
+
+	return summary
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestGameSummary(t *testing.T) {
+	game := NewGame()
+	game.Iteration = 2
+
+	players := make(map[int]*Player, 0)
+	for _, role := range []int{ROLE_MAFIA, ROLE_DOCTOR, ROLE_SHERIFF, ROLE_CITIZEN, ROLE_CITIZEN} {
+		player := NewPlayer()
+		player.SetGame(game)
+		player.SetRole(role)
+		game.Players.Add(player)
+		players[player.Id()] = player
+	}
+	mafia := game.Players.FindOneByRole(ROLE_MAFIA)
+	citizen := game.Players.FindOneByRole(ROLE_CITIZEN)
+
+	mafiaEvent := NewMafiaEvent(game.Iteration)
+	mafiaEvent.AddVoted(mafia, citizen)
+	mafiaEvent.chooseCandidate()
+	game.EventsHistory.Push(mafiaEvent)
+
+	doctorEvent := NewDoctorEvent(game.Iteration)
+	doctorEvent.SetChoice(citizen)
+	game.EventsHistory.Push(doctorEvent)
+
+	sheriffEvent := NewSheriffEvent(game.Iteration)
+	sheriffEvent.SetChoice(mafia)
+	game.EventsHistory.Push(sheriffEvent)
+
+	nightResult := NewNightResultEvent(game.Iteration)
+	nightResult.Process(game.Players, game.EventsHistory)
+	game.EventsHistory.Push(nightResult)
+
+	court := NewCourtEvent(game.Iteration)
+	for _, player := range game.Players.FindAll() {
+		if player == mafia {
+			court.AddVoted(player, citizen)
+		} else {
+			court.AddVoted(player, mafia)
+		}
+	}
+	game.EventsHistory.Push(court)
+
+	courtResult := NewCourtResultEvent(game.Iteration)
+	courtResult.Process(game.Players, game.EventsHistory)
+	game.EventsHistory.Push(courtResult)
+
+	summary := NewGameSummary(ROLE_CITIZEN, game.Players, game.EventsHistory)
+
+	if len(summary.Nights) != 1 || summary.Nights[0].MafiaTarget != citizen.Id() || summary.Nights[0].Killed != 0 || !summary.Nights[0].SheriffFound {
+		t.Errorf("Wrong nights %#v", summary.Nights)
+	}
+
+	if len(summary.Courts) != 1 || summary.Courts[0].Out != mafia.Id() || summary.Courts[0].Tally[mafia.Id()] != 4 {
+		t.Errorf("Wrong courts %#v", summary.Courts)
+	}
+
+	for _, player := range summary.Players {
+		switch players[player.Id].Role() {
+		case ROLE_MAFIA:
+			if !player.Out || player.OutBy != OUT_BY_COURT || player.OutIteration != 2 {
+				t.Errorf("Mafia must be out by court %#v", player)
+			}
+		case ROLE_DOCTOR:
+			if player.Stats.Saves != 1 {
+				t.Errorf("Doctor must have a save %#v", player)
+			}
+		case ROLE_SHERIFF:
+			if player.Stats.MafiaFound != 1 || player.Stats.CourtVotesAgainstMafia != 1 {
+				t.Errorf("Sheriff must have found mafia and voted against it %#v", player)
+			}
+		}
+	}
+
+	for {
+		if _, ok := citizen.send.Pop(); !ok {
+			break
+		}
+	}
+
+	gameOver := NewGameOverEvent(game.Iteration, ROLE_CITIZEN)
+	gameOver.Process(game.Players, game.EventsHistory)
+	if !citizen.ReceiveMessage(t, EVENT_GAME_OVER, ACTION_OVER) || !citizen.ReceiveMessage(t, EVENT_GAME_OVER, ACTION_SUMMARY) {
+		return
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/games/{id}/summary", apiGameSummary)
+	AddGame(game)
+	defer RemoveGame(game)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/games/"+strconv.Itoa(game.Id)+"/summary", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("Summary of a running game must be refused, got %d", w.Code)
+	}
+
+	game.Winner = ROLE_CITIZEN
+	game.FinishedAt = time.Now()
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/games/"+strconv.Itoa(game.Id)+"/summary", nil))
+	view := GameSummary{}
+	if w.Code != http.StatusOK || json.Unmarshal(w.Body.Bytes(), &view) != nil || view.Winner != ROLE_CITIZEN || len(view.Players) != 5 {
+		t.Errorf("Wrong summary response %d %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CertReloader serves the certificate loaded last, so certificates can be renewed without a restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	modTime  time.Time
+}
+
+func NewCertReloader(certFile string, keyFile string) *CertReloader {
+	return &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+}
+
+// Reload reads the certificate and key, the previous certificate is kept on error.
+func (c *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load certificate %s: %v", c.certFile, err)
+	}
+
+	modTime, err := c.lastModified()
+	if err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+
+	return nil
+}
+
+func (c *CertReloader) lastModified() (time.Time, error) {
+	certInfo, err := os.Stat(c.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	keyInfo, err := os.Stat(c.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+
+	return certInfo.ModTime(), nil
+}
+
+func (c *CertReloader) isModified() bool {
+	modTime, err := c.lastModified()
+	if err != nil {
+		return false
+	}
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !modTime.Equal(c.modTime)
+}
+
+func (c *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.cert, nil
+}
+
+// Watch reloads the certificate when the files change or the process gets SIGHUP.
+func (c *CertReloader) Watch(every time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Infof("SIGHUP, reload certificate %s", c.certFile)
+		case <-t.C:
+			if !c.isModified() {
+				continue
+			}
+			log.Infof("Certificate changed, reload %s", c.certFile)
+		}
+
+		if err := c.Reload(); err != nil {
+			log.Errorf("Reload certificate error: %v", err)
+		}
+	}
+}
+
+func NewTLSConfig(reloader *CertReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+}
+
+// NewRedirectServer answers plain HTTP requests with a redirect to the same URL on the TLS listener.
+func NewRedirectServer(addr string, tlsListen string) *http.Server {
+	_, tlsPort, _ := net.SplitHostPort(tlsListen)
+
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: 10 * time.Second,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, err := net.SplitHostPort(r.Host)
+			if err != nil {
+				host = strings.TrimSuffix(strings.TrimPrefix(r.Host, "["), "]")
+			}
+
+			if tlsPort != "443" {
+				host = net.JoinHostPort(host, tlsPort)
+			} else if strings.Contains(host, ":") {
+				host = "[" + host + "]"
+			}
+
+			http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+		}),
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeSelfSigned writes a new self-signed certificate for name and its key.
+func writeSelfSigned(t *testing.T, certFile string, keyFile string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Generate key err: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Create certificate err: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Marshal key err: %v", err)
+	}
+
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeSelfSigned(t, certFile, keyFile, "first")
+
+	commonName := func(reloader *CertReloader) string {
+		cert, _ := reloader.GetCertificate(nil)
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("Parse certificate err: %v", err)
+		}
+		return parsed.Subject.CommonName
+	}
+
+	reloader := NewCertReloader(certFile, keyFile)
+	if err := reloader.Reload(); err != nil {
+		t.Fatalf("Reload err: %v", err)
+	}
+	if commonName(reloader) != "first" || reloader.isModified() {
+		t.Errorf("Loaded certificate must be served and not modified")
+	}
+
+	writeSelfSigned(t, certFile, keyFile, "second")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if !reloader.isModified() {
+		t.Errorf("Renewed certificate must be modified")
+	}
+	if err := reloader.Reload(); err != nil || commonName(reloader) != "second" || reloader.isModified() {
+		t.Errorf("Renewed certificate must be served, err: %v", err)
+	}
+
+	os.WriteFile(keyFile, []byte("broken"), 0600)
+	if err := reloader.Reload(); err == nil || commonName(reloader) != "second" {
+		t.Errorf("Broken files must keep the previous certificate, err: %v", err)
+	}
+}
+
+func TestRedirectServer(t *testing.T) {
+	for _, test := range []struct {
+		tlsListen string
+		host      string
+		url       string
+		location  string
+	}{
+		{"0.0.0.0:443", "mafia.example", "/games?id=1", "https://mafia.example/games?id=1"},
+		{"0.0.0.0:443", "mafia.example:80", "/", "https://mafia.example/"},
+		{":443", "mafia.example:8080", "/ws", "https://mafia.example/ws"},
+		{"0.0.0.0:8443", "mafia.example", "/", "https://mafia.example:8443/"},
+		{"0.0.0.0:8443", "mafia.example:8080", "/info?game=2", "https://mafia.example:8443/info?game=2"},
+		{"[::]:443", "[::1]:80", "/", "https://[::1]/"},
+		{"[::]:8443", "[::1]", "/", "https://[::1]:8443/"},
+	} {
+		req := httptest.NewRequest("GET", test.url, nil)
+		req.Host = test.host
+		w := httptest.NewRecorder()
+		NewRedirectServer(":80", test.tlsListen).Handler.ServeHTTP(w, req)
+
+		if w.Code != 301 || w.Header().Get("Location") != test.location {
+			t.Errorf("Redirect of %s%s with tls on %s: %d %s, must be %s", test.host, test.url, test.tlsListen, w.Code, w.Header().Get("Location"), test.location)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const TRANSPORT_WEBSOCKET = "websocket"
+const TRANSPORT_SSE = "sse"
+
+var Clients = NewClientSet()
+
+// Transport moves encoded messages between a client and a player.
+// Inbound messages are passed to Player.OnMessage, outbound messages are read from the player send channel.
+type Transport interface {
+	Name() string
+	Run(player *Player)
+	Close()
+}
+
+/*
+ClientSet
+*/
+
+// ClientSet holds players with an open transport.
+type ClientSet struct {
+	mutex sync.Mutex
+	data  map[*Player]bool
+}
+
+func NewClientSet() *ClientSet {
+	return &ClientSet{data: make(map[*Player]bool, 0)}
+}
+
+func (c *ClientSet) Add(player *Player) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.data[player] = true
+}
+
+func (c *ClientSet) Remove(player *Player) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.data, player)
+}
+
+func (c *ClientSet) Has(player *Player) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.data[player]
+}
+
+func (c *ClientSet) FindAll() []*Player {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	players := make([]*Player, 0, len(c.data))
+	for player := range c.data {
+		players = append(players, player)
+	}
+	return players
+}
+
+func (c *ClientSet) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.data)
+}
+
+/*
+WebsocketTransport
+*/
+type WebsocketTransport struct {
+	conn *websocket.Conn
+}
+
+func NewWebsocketTransport(conn *websocket.Conn) *WebsocketTransport {
+	return &WebsocketTransport{conn: conn}
+}
+
+func (t *WebsocketTransport) Name() string {
+	return TRANSPORT_WEBSOCKET
+}
+
+func (t *WebsocketTransport) Run(player *Player) {
+	go t.readLoop(player)
+	go t.writeLoop(player)
+}
+
+// Close tells the client the server is going away and closes the connection.
+func (t *WebsocketTransport) Close() {
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown")
+	err := t.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	if err != nil {
+		log.Debugf("Close message error: %v", err)
+	}
+	t.conn.Close()
+}
+
+func (t *WebsocketTransport) readLoop(p *Player) {
+	p.Log().Debug("readLoop")
+	defer func() {
+
+		if err := recover(); err != nil {
+			p.Log().Errorf("Close readLoop err: %v", err)
+		}
+
+		p.Log().Debug("Closing on read end")
+		t.conn.Close()
+		p.Disconnect()
+
+	}()
+
+	t.conn.SetReadLimit(maxMessageSize)
+
+	for {
+		_, message, err := t.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				p.Log().Infof("Read err: %v", err)
+			}
+			break
+		}
+
+		msg := &Message{}
+		err = p.codec.Unmarshal(message, msg)
+		if err != nil {
+			p.Log().Errorf("Decode message err: %v, msg: %s", err, string(message))
+			break
+		}
+
+		if log.IsLevelEnabled(log.DebugLevel) {
+			p.Log().WithField("action", msg.Action).Debugf("rcv msg %#v", msg)
+		}
+
+		if !p.Receive(msg) {
+			break
+		}
+	}
+}
+
+func (t *WebsocketTransport) writeLoop(p *Player) {
+	p.Log().Debug("writeLoop")
+	defer func() {
+
+		if err := recover(); err != nil {
+			p.Log().Errorf("Close writeLoop err: %v", err)
+		}
+
+		p.Log().Debug("Closing on write end")
+		t.conn.Close()
+	}()
+
+	for {
+		item, ok := p.send.Wait()
+		if !ok {
+			if p.send.Overflowed() {
+				t.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "outbound queue overflow"))
+			} else {
+				t.conn.WriteMessage(websocket.CloseMessage, []byte{})
+			}
+			return
+		}
+
+		w, err := t.conn.NextWriter(p.codec.MessageType())
+		if err != nil {
+			p.Log().WithField("action", item.Message.Action).Errorf("Get writer err: %v", err)
+			return
+		}
+
+		if log.IsLevelEnabled(log.DebugLevel) {
+			p.Log().WithField("action", item.Message.Action).Debugf("snd msg %#v", item.Message)
+		}
+
+		if _, err = w.Write(item.Data); err != nil {
+			p.Log().WithField("action", item.Message.Action).Infof("Write err: %v", err)
+			return
+		}
+
+		if err := w.Close(); err != nil {
+			p.Log().WithField("action", item.Message.Action).Infof("Close writer err: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+const sseKeepAlive = 15 * time.Second
+const ssePollTimeout = 25 * time.Second
+const sseSessionTTL = time.Minute
+
+var SSESessions = NewSSESessionStore()
+
+func GenerateToken(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+
+	if err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+/*
+SSETransport
+*/
+
+// SSETransport serves a player over plain HTTP for clients that can not open a websocket:
+// actions are POSTed, server messages are read from a Server-Sent Events stream or by long polling.
+type SSETransport struct {
+	id       string
+	player   *Player
+	mutex    sync.Mutex
+	receive  sync.Mutex
+	attached bool
+	lastSeen time.Time
+	closed   chan struct{}
+	once     sync.Once
+	ended    sync.Once
+}
+
+func NewSSETransport() *SSETransport {
+	return &SSETransport{
+		id:       GenerateToken(16),
+		lastSeen: time.Now(),
+		closed:   make(chan struct{}),
+	}
+}
+
+func (t *SSETransport) Id() string {
+	return t.id
+}
+
+func (t *SSETransport) Name() string {
+	return TRANSPORT_SSE
+}
+
+func (t *SSETransport) Run(player *Player) {
+	t.player = player
+	player.SetCodec(FindCodec(CODEC_JSON))
+	SSESessions.Add(t)
+}
+
+// Close forgets the session and ends a running stream.
+func (t *SSETransport) Close() {
+	SSESessions.Remove(t)
+	t.once.Do(func() {
+		close(t.closed)
+	})
+}
+
+// end closes the session and releases the player.
+func (t *SSETransport) end() {
+	t.ended.Do(func() {
+		t.Close()
+		t.player.Disconnect()
+	})
+}
+
+func (t *SSETransport) touch() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lastSeen = time.Now()
+}
+
+// attach marks the outbound queue as read by a client, only one reader is allowed at a time.
+func (t *SSETransport) attach() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.attached {
+		return false
+	}
+
+	t.attached = true
+	t.lastSeen = time.Now()
+	return true
+}
+
+func (t *SSETransport) detach() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.attached = false
+	t.lastSeen = time.Now()
+}
+
+func (t *SSETransport) isIdle(ttl time.Duration) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return !t.attached && time.Since(t.lastSeen) > ttl
+}
+
+/*
+SSESessionStore
+*/
+type SSESessionStore struct {
+	mutex sync.Mutex
+	data  map[string]*SSETransport
+}
+
+func NewSSESessionStore() *SSESessionStore {
+	return &SSESessionStore{data: make(map[string]*SSETransport, 0)}
+}
+
+func (s *SSESessionStore) Add(transport *SSETransport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.data[transport.Id()] = transport
+}
+
+func (s *SSESessionStore) Remove(transport *SSETransport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.data, transport.Id())
+}
+
+func (s *SSESessionStore) Find(id string) *SSETransport {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.data[id]
+}
+
+// Cleanup ends sessions nobody has read from for longer than ttl, through the same end as a flooding client.
+// The player stays in the game and can come back with the reconnect action.
+func (s *SSESessionStore) Cleanup(ttl time.Duration) {
+	s.mutex.Lock()
+	expired := make([]*SSETransport, 0)
+	for _, transport := range s.data {
+		if transport.isIdle(ttl) {
+			expired = append(expired, transport)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, transport := range expired {
+		transport.player.Log().Debugf("SSE session expired %s", transport.Id())
+		transport.end()
+	}
+}
+
+func SSEGC(every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for range t.C {
+		SSESessions.Cleanup(sseSessionTTL)
+	}
+}
+
+/*
+Handlers
+*/
+
+// sseConnect creates a player and returns the session used by the other sse endpoints.
+func sseConnect(w http.ResponseWriter, r *http.Request) {
+	ip := RemoteIP(r.RemoteAddr)
+	if !Connections.Acquire(ip) {
+		http.Error(w, "too many connections", http.StatusTooManyRequests)
+		return
+	}
+
+	transport := NewSSETransport()
+
+	player := NewPlayer()
+	player.SetAddr(r.RemoteAddr)
+	player.SetConnectionIp(ip)
+	player.SetTransport(transport)
+
+	player.Log().Debugf("SSE connect %s", transport.Id())
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{"session": transport.Id()})
+	if err != nil {
+		log.Errorf("SSE connect error: %v", err)
+	}
+}
+
+// sseAction reads one message from the request body and passes it to the player.
+func sseAction(w http.ResponseWriter, r *http.Request) {
+	transport := SSESessions.Find(mux.Vars(r)["session"])
+	if transport == nil {
+		http.Error(w, "invalid session", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	if err != nil {
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	msg := &Message{}
+	err = transport.player.Codec().Unmarshal(body, msg)
+	if err != nil {
+		transport.player.Log().Errorf("Decode message err: %v, msg: %s", err, string(body))
+		http.Error(w, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	transport.touch()
+
+	if log.IsLevelEnabled(log.DebugLevel) {
+		transport.player.Log().WithField("action", msg.Action).Debugf("rcv msg %#v", msg)
+	}
+
+	// actions of a session are handled one at a time, like the reads of a websocket
+	transport.receive.Lock()
+	allowed := transport.player.Receive(msg)
+	transport.receive.Unlock()
+
+	if !allowed {
+		transport.end()
+		http.Error(w, "too many messages", http.StatusTooManyRequests)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sseStream writes server messages as an event stream, or as a JSON list when called with ?poll=1.
+func sseStream(w http.ResponseWriter, r *http.Request) {
+	transport := SSESessions.Find(mux.Vars(r)["session"])
+	if transport == nil {
+		http.Error(w, "invalid session", http.StatusNotFound)
+		return
+	}
+
+	if !transport.attach() {
+		http.Error(w, "session is already read by another request", http.StatusConflict)
+		return
+	}
+	defer transport.detach()
+
+	if transport.player.send.Overflowed() {
+		transport.end()
+		http.Error(w, "outbound queue overflow, reconnect", http.StatusGone)
+		return
+	}
+
+	if r.URL.Query().Get("poll") != "" {
+		ssePoll(w, r, transport.player)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	player := transport.player
+	for {
+		if item, ok := player.send.Pop(); ok {
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", item.Data); err != nil {
+				player.Log().Infof("SSE write err: %v", err)
+				return
+			}
+			flusher.Flush()
+			continue
+		}
+
+		if player.send.Closed() {
+			if player.send.Overflowed() {
+				transport.end()
+			}
+			return
+		}
+
+		select {
+		case <-player.send.Ready():
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-transport.closed:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// ssePoll waits for at least one message and returns everything queued for the player.
+func ssePoll(w http.ResponseWriter, r *http.Request, player *Player) {
+	messages := make([]json.RawMessage, 0)
+
+	timeout := time.NewTimer(ssePollTimeout)
+	defer timeout.Stop()
+
+wait:
+	for player.send.Len() == 0 && !player.send.Closed() {
+		select {
+		case <-player.send.Ready():
+		case <-timeout.C:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	for {
+		item, ok := player.send.Pop()
+		if !ok {
+			break
+		}
+		messages = append(messages, item.Data)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(messages)
+	if err != nil {
+		log.Errorf("SSE poll error: %v", err)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// sseBot plays over the sse endpoints, it votes for a random player whenever it gets the list of players.
+type sseBot struct {
+	t       *testing.T
+	url     string
+	session string
+	id      int
+	games   chan int
+	over    chan bool
+}
+
+func newSSEBot(t *testing.T, url string) *sseBot {
+	resp, err := http.Post(url+"/sse", "application/json", nil)
+	if err != nil {
+		t.Fatalf("SSE connect err: %v", err)
+	}
+	defer resp.Body.Close()
+
+	session := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil || session["session"] == "" {
+		t.Fatalf("SSE connect must return a session, err: %v", err)
+	}
+
+	return &sseBot{t: t, url: url, session: session["session"], games: make(chan int, 1), over: make(chan bool, 1)}
+}
+
+// end ends the session, so its stream or poll returns and the test server can close.
+func (b *sseBot) end() {
+	if transport := SSESessions.Find(b.session); transport != nil {
+		transport.end()
+	}
+}
+
+func (b *sseBot) send(msg *Message) {
+	body, _ := json.Marshal(msg)
+	resp, err := http.Post(b.url+"/sse/"+b.session, "application/json", bytes.NewReader(body))
+	if err != nil {
+		b.t.Errorf("SSE action err: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		b.t.Errorf("SSE action %s got %d", msg.Action, resp.StatusCode)
+	}
+}
+
+func (b *sseBot) receive(data []byte) {
+	msg := &Message{}
+	if err := json.Unmarshal(data, msg); err != nil || msg.Status != STATUS_OK {
+		return
+	}
+
+	switch msg.Action {
+	case ACTION_CREATE, ACTION_JOIN:
+		info := msg.Data.(map[string]interface{})
+		b.id = int(info["id"].(float64))
+		b.games <- int(info["game"].(float64))
+	case ACTION_OVER:
+		b.over <- true
+	case ACTION_PLAYERS:
+		if msg.Event != EVENT_MAFIA && msg.Event != EVENT_COURT {
+			return
+		}
+		candidates := make([]float64, 0)
+		for _, info := range msg.Data.([]interface{}) {
+			if id := info.(map[string]interface{})["id"].(float64); int(id) != b.id {
+				candidates = append(candidates, id)
+			}
+		}
+		if len(candidates) > 0 {
+			go b.send(&Message{Event: msg.Event, Iteration: msg.Iteration, Action: ACTION_VOTE, Data: candidates[rand.Intn(len(candidates))]})
+		}
+	}
+}
+
+// stream reads the event stream until it ends.
+func (b *sseBot) stream() {
+	resp, err := http.Get(b.url + "/sse/" + b.session)
+	if err != nil {
+		b.t.Errorf("SSE stream err: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		b.t.Errorf("Wrong stream content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			b.receive([]byte(strings.TrimPrefix(line, "data: ")))
+		}
+	}
+}
+
+// poll long polls until the session is gone.
+func (b *sseBot) poll() {
+	for {
+		resp, err := http.Get(b.url + "/sse/" + b.session + "?poll=1")
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return
+		}
+
+		messages := make([]json.RawMessage, 0)
+		err = json.NewDecoder(resp.Body).Decode(&messages)
+		resp.Body.Close()
+		if err != nil {
+			return
+		}
+
+		for _, data := range messages {
+			b.receive(data)
+		}
+	}
+}
+
+func sseRouter() *mux.Router {
+	r := mux.NewRouter()
+	r.HandleFunc("/sse", sseConnect).Methods("POST")
+	r.HandleFunc("/sse/{session}", sseStream).Methods("GET")
+	r.HandleFunc("/sse/{session}", sseAction).Methods("POST")
+	return r
+}
+
+func TestSSEGame(t *testing.T) {
+	timeouts, roles := Conf.Timeouts, Conf.Roles
+	t.Cleanup(func() { Conf.Timeouts, Conf.Roles = timeouts, roles })
+	Conf.Roles = RoleSetup{MafiaDivisor: 3}
+	Conf.Timeouts.Accept = 2 * time.Millisecond
+	Conf.Timeouts.Vote = 100 * time.Millisecond
+
+	server := httptest.NewServer(sseRouter())
+	defer server.Close()
+
+	master := newSSEBot(t, server.URL)
+	defer master.end()
+	go master.stream()
+	master.send(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: map[string]interface{}{"username": "master"}})
+
+	var gameId int
+	select {
+	case gameId = <-master.games:
+	case <-time.After(time.Second):
+		t.Fatalf("Master must get the created game over the stream")
+	}
+	game, _ := FindGame(gameId)
+	stopGame(t, game)
+
+	for _, name := range []string{"anton", "boris"} {
+		bot := newSSEBot(t, server.URL)
+		defer bot.end()
+		go bot.poll()
+		bot.send(&Message{Event: EVENT_GAME, Action: ACTION_JOIN, Data: map[string]interface{}{"username": name, "game": float64(gameId)}})
+		select {
+		case <-bot.games:
+		case <-time.After(time.Second):
+			t.Fatalf("Player must join over long polling")
+		}
+	}
+
+	master.send(&Message{Event: EVENT_GAME, Action: ACTION_START})
+
+	select {
+	case <-master.over:
+	case <-time.After(10 * time.Second):
+		event, _ := currentEvent(game)
+		t.Fatalf("Game over sse is not over, event: %s", event.Name())
+	}
+
+	winner := 0
+	locked(game, func() { winner = game.Winner })
+	if winner == 0 {
+		t.Errorf("Finished game must have a winner")
+	}
+}
+
+func TestSSECleanupEndsOnce(t *testing.T) {
+	server := httptest.NewServer(sseRouter())
+	defer server.Close()
+
+	expired := newSSEBot(t, server.URL)
+	kept := newSSEBot(t, server.URL)
+	defer kept.end()
+
+	ip := RemoteIP(SSESessions.Find(kept.session).player.Addr())
+	if Connections.data[ip] != 2 {
+		t.Fatalf("Both sessions must hold a connection, got %d", Connections.data[ip])
+	}
+
+	transport := SSESessions.Find(expired.session)
+	transport.lastSeen = time.Now().Add(-time.Hour)
+	SSESessions.Cleanup(time.Minute)
+	transport.end()
+
+	if SSESessions.Find(expired.session) != nil || Connections.data[ip] != 1 {
+		t.Errorf("Expired session must be ended once, connections: %d", Connections.data[ip])
+	}
+}
+
+func TestSSEConcurrentActions(t *testing.T) {
+	server := httptest.NewServer(sseRouter())
+	defer server.Close()
+
+	bot := newSSEBot(t, server.URL)
+	defer bot.end()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bot.send(&Message{Event: EVENT_GAME, Action: ACTION_CREATE, Data: map[string]interface{}{"username": "master"}})
+		}()
+	}
+	wg.Wait()
+
+	player := SSESessions.Find(bot.session).player
+	created := 0
+	for _, game := range FindGames() {
+		if game.Players.FindMaster() == player {
+			created++
+			stopGame(t, game)
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("Concurrent creates of one session must make one game, got %d", created)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// BenchmarkBroadcast sends a vote to every player of a 20 player game over websockets.
+func BenchmarkBroadcast(b *testing.B) {
+	const playersCount = 20
+
+	level := log.GetLevel()
+	log.SetLevel(log.InfoLevel)
+	defer log.SetLevel(level)
+
+	limits := Conf.Limits
+	Conf.Limits.ConnectionsPerIP = 0
+	Conf.Limits.OutboundQueue = b.N + 1
+	defer func() { Conf.Limits = limits }()
+
+	server := httptest.NewServer(http.HandlerFunc(ws))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	var wg sync.WaitGroup
+	for i := 0; i < playersCount; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			b.Fatalf("Dial err: %v", err)
+		}
+		defer conn.Close()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < b.N; n++ {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					b.Errorf("Read err: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for Clients.Len() != playersCount {
+		if time.Now().After(deadline) {
+			b.Fatalf("Wrong clients count %d", Clients.Len())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	game := NewGame()
+	for _, player := range Clients.FindAll() {
+		player.SetGame(game)
+		game.Players.Add(player)
+	}
+
+	rmsg := &Message{
+		Status: STATUS_OK,
+		Event:  EVENT_COURT,
+		Action: ACTION_VOTE,
+		Data:   map[string]interface{}{"player": "player", "vote": "candidate"},
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, player := range game.Players.FindAll() {
+			player.SendMessage(rmsg)
+		}
+	}
+	wg.Wait()
+	b.StopTimer()
+
+	b.ReportMetric(float64(b.N*playersCount)/b.Elapsed().Seconds(), "msgs/s")
+}
+
+func TestWebsocketReleasesConnection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(ws))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	// clients closing at once must release the connection of their ip, not of an empty address
+	for i := 0; i < 10; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			t.Fatalf("Dial err: %v", err)
+		}
+		conn.Close()
+	}
+
+	released := waitFor(func() bool {
+		Connections.mutex.Lock()
+		defer Connections.mutex.Unlock()
+		return Connections.data["127.0.0.1"] == 0 && Connections.data[""] == 0
+	})
+	if !released {
+		t.Errorf("Closed connections must be released %v", Connections.data)
+	}
+}